@@ -1,128 +1,611 @@
 package access
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net/netip"
 	"net/url"
+	"regexp"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/exp/slices"
 	"gopkg.in/yaml.v3"
 )
 
 type Site struct {
+	// ID はサイトを識別するのに使う。省略した場合は host とパスの指定から作る。
+	ID                 string   `yaml:"id"`
 	Host               string   `yaml:"host"`
 	PathPrefix         string   `yaml:"pathPrefix"`
+	PathGlob           string   `yaml:"pathGlob"`
+	PathRegex          string   `yaml:"pathRegex"`
 	Roles              []string `yaml:"roles"`
 	Backend            string   `yaml:"backend"`
 	DisguiseHostHeader bool     `yaml:"disguiseHostHeader"`
+
+	// Extends で指定したテンプレートから、書かなかった値を引き継ぐ
+	Extends string `yaml:"extends"`
+
+	// Auth はログインを求めるかどうか。省略した場合は required になる。
+	Auth AuthMode `yaml:"auth"`
+	// PublicPaths にマッチするパスは Auth によらずログインなしで通す。書き方は pathGlob と同じ。
+	PublicPaths []string `yaml:"publicPaths"`
+
+	// Methods を書いた場合、それ以外のメソッドは 405 にする
+	Methods []string `yaml:"methods"`
+	// MethodRoles を書いた場合、マッチしたメソッドには Roles の代わりにそのロールを求める
+	MethodRoles []MethodRole `yaml:"methodRoles"`
+
+	// Require はクレームを参照する式で、書いた場合はロールに加えてこの式が true になることを求める
+	Require string `yaml:"require"`
+
+	// NotBefore より前と NotAfter 以降はアクセスできない
+	NotBefore *time.Time `yaml:"notBefore"`
+	NotAfter  *time.Time `yaml:"notAfter"`
+	Schedules []Schedule `yaml:"schedules"`
+
+	AllowCIDRs []string `yaml:"allowCIDRs"`
+	DenyCIDRs  []string `yaml:"denyCIDRs"`
+
+	// Backends を書いた場合は Backend の代わりに、Balance の方法で振り分ける
+	Backends    []string      `yaml:"backends"`
+	Balance     Balance       `yaml:"balance"`
+	HealthCheck *HealthCheck  `yaml:"healthCheck"`
+	MaxFails    int           `yaml:"maxFails"`
+	FailTimeout time.Duration `yaml:"failTimeout"`
+	Transport   *Transport    `yaml:"transport"`
+
+	// IdentityHeaders を書いた場合、ユーザーの情報をヘッダーでバックエンドに送る
+	IdentityHeaders *IdentityHeaders `yaml:"identityHeaders"`
+	// Assertion を書いた場合、ユーザーの情報を署名した JWT をバックエンドに送る
+	Assertion *Assertion `yaml:"assertion"`
+	// Signing を書いた場合、リクエストに HMAC で署名する
+	Signing *Signing `yaml:"signing"`
+	// PassAccessToken を true にすると、ユーザーのアクセストークンを Authorization ヘッダーで送る。token_type が Bearer のものだけ送る
+	PassAccessToken bool `yaml:"passAccessToken"`
+
+	// バックエンドに送るパスの書き換え
+	StripPrefix string        `yaml:"stripPrefix"`
+	AddPrefix   string        `yaml:"addPrefix"`
+	Rewrites    []PathRewrite `yaml:"rewrites"`
+
+	path        *pathMatcher
+	publicPaths []*regexp.Regexp
+	require     expr
+	allowCIDRs  []netip.Prefix
+	denyCIDRs   []netip.Prefix
+	pos         position
+	// 設定に書かれていたキー。テンプレートから引き継ぐかどうかの判定に使う
+	setFields map[string]bool
 }
 
-type SettingList struct {
-	Sites []Site `yaml:"sites"`
+type MethodRole struct {
+	Methods []string `yaml:"methods"`
+	Roles   []string `yaml:"roles"`
 }
 
-var _listYml string
-var _listCache *SettingList
+type AuthMode string
 
-func Initialize(listYml string) SettingList {
-	if _listCache != nil {
-		return *_listCache
-	}
+const (
+	// AuthRequired はログインとアクセス権限を求める
+	AuthRequired AuthMode = "required"
+	// AuthOptional はログインしていてアクセス権限があればユーザーの情報を送るが、なくてもそのまま通す
+	AuthOptional AuthMode = "optional"
+	// AuthPublic はログインを求めない
+	AuthPublic AuthMode = "public"
+)
 
-	var l SettingList
-	if err := yaml.Unmarshal([]byte(listYml), &l); err != nil {
-		panic(err)
-	}
+var ErrInvalidAuthMode = errors.New("auth must be one of required, optional and public")
+
+type SettingList struct {
+	RoleGroups map[string][]string `yaml:"roleGroups"`
+	Defaults   *Site               `yaml:"defaults"`
+	Templates  map[string]Site     `yaml:"templates"`
 
-	_listYml = listYml
-	_listCache = &l
-	return *_listCache
+	Sites  []Site `yaml:"sites"`
+	Denies []Deny `yaml:"denies"`
+	// X-Forwarded-For を信頼するプロキシのアドレス
+	TrustedProxies []string `yaml:"trustedProxies"`
+
+	trustedProxies []netip.Prefix
+}
+
+type loadedList struct {
+	list SettingList
+	hash string
 }
 
-func CanAccess(requestUrl url.URL, accessMap string) bool {
-	siteIndex, err := findMatchSiteIndex(requestUrl, *_listCache)
+// リロード中もリクエストを捌けるように、読み込み済みの設定はまとめて差し替える
+var current atomic.Pointer[loadedList]
+
+// Load は path から設定を読み込み、現在の設定と差し替える。path にはファイルかディレクトリを指定できる。
+// 読み込みに失敗した場合は現在の設定をそのまま使い続ける。
+func Load(path string) error {
+	files, err := readListFiles(path)
 	if err != nil {
-		log.Println("対応するサイトが見つからない")
-		return false
+		return err
 	}
 
-	m, err := parseAccessMap(accessMap)
+	l, err := parseFiles(files)
 	if err != nil {
-		log.Println("accessMap のパースに失敗")
-		return false
+		return err
 	}
 
-	return slices.Contains(m, siteIndex)
+	loaded := &loadedList{
+		list: *l,
+		hash: hashFiles(files),
+	}
+	for _, f := range loadHooks {
+		if err := f(&loaded.list); err != nil {
+			return err
+		}
+	}
+	current.Store(loaded)
+	return nil
+}
+
+var loadHooks []func(l *SettingList) error
+
+// OnLoad は設定を読み込むたびに、差し替える直前に f を呼ぶようにする。Load より前に呼ぶ。
+// f がエラーを返した場合は、残りの f を呼ばずに読み込みを失敗させる。
+func OnLoad(f func(l *SettingList) error) {
+	loadHooks = append(loadHooks, f)
 }
 
-func SiteConfig(requestUrl url.URL) (*Site, error) {
-	site, err := findMatchSite(requestUrl, *_listCache)
+// ParsePath は path から設定を読み込む。Load と違い、現在の設定は変えない。
+func ParsePath(path string) (*SettingList, error) {
+	files, err := readListFiles(path)
 	if err != nil {
-		log.Println("対応するサイトがない")
 		return nil, err
 	}
+	return parseFiles(files)
+}
 
-	return site, nil
+func parseFiles(files []listFile) (*SettingList, error) {
+	l, errs := decodeFiles(files)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	if errs := compileList(l); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return l, nil
+}
+
+// decodeList は YAML をデコードする。エラーの場合もデコードできたところまでを返す。
+func decodeList(listYml string) (*SettingList, error) {
+	var l SettingList
+
+	dec := yaml.NewDecoder(strings.NewReader(listYml))
+	// typo に気づけるように、知らないキーはエラーにする
+	dec.KnownFields(true)
+	if err := dec.Decode(&l); err != nil && !errors.Is(err, io.EOF) {
+		return &l, err
+	}
+	return &l, nil
+}
+
+// listError は設定のどの項目で起きたエラーなのかを保持する
+type listError struct {
+	// sites, denies, trustedProxies のどれか
+	section string
+	index   int
+	pos     position
+	err     error
+}
+
+func (e *listError) Error() string {
+	if e.pos.file != "" {
+		return fmt.Sprintf("%s: %s", e.pos, e.detail())
+	}
+	return fmt.Sprintf("%s[%d]: %s", e.section, e.index, e.err)
 }
 
-func BackendURL(requestUrl url.URL) string {
-	siteIndex, err := findMatchSiteIndex(requestUrl, *_listCache)
+func (e *listError) detail() string {
+	return fmt.Sprintf("%s: %s", e.section, e.err)
+}
+
+func (e *listError) Unwrap() error {
+	return e.err
+}
+
+// compileList は設定を検証して、判定に使う値を準備する。見つかったエラーはすべて返す。
+func compileList(l *SettingList) []*listError {
+	var errs []*listError
+
+	ids := make(map[string]*Site)
+	paths := make(map[string]*Site)
+	for i := range l.Sites {
+		site := &l.Sites[i]
+		siteErr := func(err error) *listError {
+			return &listError{section: "sites", index: i, pos: site.pos, err: err}
+		}
+
+		if err := expandSite(site, l); err != nil {
+			errs = append(errs, siteErr(err))
+			continue
+		}
+		if err := compileSite(site); err != nil {
+			errs = append(errs, siteErr(err))
+			continue
+		}
+
+		if other, ok := ids[site.ID]; ok {
+			errs = append(errs, siteErr(fmt.Errorf("site id %s が %s と重複している", site.ID, other.describe())))
+			continue
+		}
+		ids[site.ID] = site
+
+		// 大文字小文字や末尾の . だけが違うホストや、書き方だけが違うパスも重複とみなす
+		host, port := splitHostPort(site.Host)
+		key := host + ":" + port + " " + site.path.key()
+		if other, ok := paths[key]; ok {
+			errs = append(errs, siteErr(fmt.Errorf("host とパスの組み合わせが %s と重複している", other.describe())))
+			continue
+		}
+		paths[key] = site
+	}
+
+	for i, v := range l.TrustedProxies {
+		if _, err := parseCIDRs([]string{v}); err != nil {
+			errs = append(errs, &listError{section: "trustedProxies", index: i, err: err})
+		}
+	}
+	if len(errs) == 0 {
+		l.trustedProxies, _ = parseCIDRs(l.TrustedProxies)
+	}
+
+	for i := range l.Denies {
+		d := &l.Denies[i]
+		var err error
+		if d.ExceptRoles, err = expandRoles(d.ExceptRoles, l.RoleGroups); err == nil {
+			err = compileDeny(d)
+		}
+		if err != nil {
+			errs = append(errs, &listError{section: "denies", index: i, pos: d.pos, err: err})
+		}
+	}
+
+	return errs
+}
+
+// describe はエラーメッセージでサイトを指すための文字列を返す。
+func (site *Site) describe() string {
+	if site.pos.file != "" {
+		return fmt.Sprintf("%s (%s)", site.ID, site.pos)
+	}
+	return site.ID
+}
+
+func compileSite(site *Site) error {
+	if site.ID == "" {
+		site.ID = site.Host + site.PathPrefix + site.PathGlob + site.PathRegex
+	}
+	if err := validateHostPattern(site.Host); err != nil {
+		return fmt.Errorf("%w: %s", err, site.Host)
+	}
+	m, err := compilePathMatcher(site.PathPrefix, site.PathGlob, site.PathRegex)
 	if err != nil {
-		return ""
+		return err
+	}
+	site.path = m
+	if err := compileBackends(site); err != nil {
+		return err
+	}
+	if err := compileAuth(site); err != nil {
+		return err
+	}
+	normalizeMethods(site)
+	if site.Require != "" {
+		e, err := compileExpr(site.Require)
+		if err != nil {
+			return err
+		}
+		site.require = e
+	}
+	if err := compileTimeWindow(site); err != nil {
+		return err
+	}
+	if err := compileNetwork(site); err != nil {
+		return err
+	}
+	if err := compileRewrite(site); err != nil {
+		return err
+	}
+	if err := compileIdentityHeaders(site); err != nil {
+		return err
+	}
+	if err := compileAssertion(site); err != nil {
+		return err
 	}
+	if err := compileSigning(site); err != nil {
+		return err
+	}
+	return nil
+}
+
+var ErrInvalidBackend = errors.New("backend must be an absolute http(s) URL")
 
-	return _listCache.Sites[siteIndex].Backend
+func validateBackend(backend string) error {
+	u, err := url.Parse(backend)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: %q", ErrInvalidBackend, backend)
+	}
+	return nil
 }
 
-func CalculateListHash() string {
-	b := sha256.Sum256([]byte(_listYml))
-	return hex.EncodeToString(b[:])
+func compileAuth(site *Site) error {
+	switch site.Auth {
+	case "":
+		site.Auth = AuthRequired
+	case AuthRequired, AuthOptional, AuthPublic:
+	default:
+		return ErrInvalidAuthMode
+	}
+
+	for _, p := range site.PublicPaths {
+		if !strings.HasPrefix(p, "/") {
+			return ErrInvalidPathPattern
+		}
+		re, err := regexp.Compile(globToRegexp(p))
+		if err != nil {
+			return ErrInvalidPathPattern
+		}
+		site.publicPaths = append(site.publicPaths, re)
+	}
+	return nil
 }
 
-func GetAccessMap(roles []string) string {
-	m := getAvailableSitesIndex(roles, *_listCache)
-	b, _ := json.Marshal(m)
-	return string(b)
+// AuthModeFor はリクエストに対してどこまでログインを求めるかを返す。
+// denies にマッチするリクエストは、公開されたパスであってもログインを求める。
+func (s Snapshot) AuthModeFor(req Request, site *Site) AuthMode {
+	return authModeFor(req, site, *s.list)
 }
 
-func parseAccessMap(v string) ([]int, error) {
-	var j []int
-	if err := json.Unmarshal([]byte(v), &j); err != nil {
-		return nil, err
+func authModeFor(req Request, site *Site, list SettingList) AuthMode {
+	if len(matchDenies(req, list)) > 0 {
+		return AuthRequired
 	}
-	return j, nil
+	return siteAuthMode(req, site)
 }
 
-func getAvailableSitesIndex(roles []string, list SettingList) []int {
-	var r []int
-	for i, site := range list.Sites {
-		for _, role := range roles {
-			if slices.Contains(site.Roles, role) {
-				r = append(r, i)
-				continue
-			}
+// siteAuthMode は denies を考えずに、サイトの auth と publicPaths だけで決まるモードを返す。
+func siteAuthMode(req Request, site *Site) AuthMode {
+	for _, re := range site.publicPaths {
+		if re.MatchString(req.URL.Path) {
+			return AuthPublic
 		}
 	}
+	return site.Auth
+}
 
-	return r
+func normalizeMethods(site *Site) {
+	for i := range site.Methods {
+		site.Methods[i] = strings.ToUpper(site.Methods[i])
+	}
+	for i := range site.MethodRoles {
+		for j := range site.MethodRoles[i].Methods {
+			site.MethodRoles[i].Methods[j] = strings.ToUpper(site.MethodRoles[i].Methods[j])
+		}
+	}
 }
 
+// AllowsMethod は、ロールに関係なくサイトがそのメソッドを受け付けるかどうかを返す。
+func (site *Site) AllowsMethod(method string) bool {
+	if len(site.Methods) == 0 {
+		return true
+	}
+	return slices.Contains(site.Methods, method)
+}
+
+// RolesFor はメソッドに対して求めるロールを返す。
+func (site *Site) RolesFor(method string) []string {
+	for _, mr := range site.MethodRoles {
+		if slices.Contains(mr.Methods, method) {
+			return mr.Roles
+		}
+	}
+	return site.Roles
+}
+
+func loaded() *loadedList {
+	l := current.Load()
+	if l == nil {
+		panic("call access.Load() first.")
+	}
+	return l
+}
+
+// Request はアクセス判定に使うリクエストの情報
+type Request struct {
+	URL    url.URL
+	Method string
+	// 省略した場合は現在時刻
+	Time time.Time
+	// ClientIP で求めたクライアントのアドレス
+	ClientIP netip.Addr
+}
+
+func (req Request) now() time.Time {
+	if req.Time.IsZero() {
+		return time.Now()
+	}
+	return req.Time
+}
+
+// Decision はアクセス判定の結果
+type Decision int
+
+const (
+	Allowed Decision = iota
+	Denied
+	MethodNotAllowed
+	NotYetOpen
+	AlreadyClosed
+	OutsideSchedule
+	NetworkDenied
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Allowed:
+		return "allowed"
+	case Denied:
+		return "denied"
+	case MethodNotAllowed:
+		return "method-not-allowed"
+	case NotYetOpen:
+		return "not-yet-open"
+	case AlreadyClosed:
+		return "already-closed"
+	case OutsideSchedule:
+		return "outside-schedule"
+	case NetworkDenied:
+		return "network-denied"
+	}
+	return "unknown"
+}
+
+func (d Decision) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Identity はアクセス判定に使うユーザーの情報
+type Identity struct {
+	Roles []string
+	// ID Token のクレーム
+	Claims map[string]any
+}
+
+// CanAccess はログインしたユーザーが site にアクセスできるかどうかを判定する。site は同じ Snapshot の SiteConfig で探したもの。
+func (s Snapshot) CanAccess(req Request, site *Site, id Identity) Decision {
+	if d := CheckSite(req, site); d != Allowed {
+		return d
+	}
+
+	if isDenied(req, id, *s.list) {
+		return Denied
+	}
+
+	if !site.allows(req.Method, id) && !loginRequiredOnlyByDeny(req, site, *s.list) {
+		return Denied
+	}
+	return Allowed
+}
+
+// loginRequiredOnlyByDeny は、public か optional のパスへのリクエストに deny がマッチしたために、ログインを求めたかどうかを返す。
+// その場合は exceptRoles で除外されたユーザーを、サイトの roles や require によらず通す。
+// そうしないと、roles を書かない public のサイトでは exceptRoles のロールを持っていても誰も通れない。
+func loginRequiredOnlyByDeny(req Request, site *Site, list SettingList) bool {
+	return siteAuthMode(req, site) != AuthRequired && len(matchDenies(req, list)) > 0
+}
+
+// CheckSite はユーザーによらないサイト単位の判定 (メソッド、接続元、公開期間) を行う。
+// ログインを求めないパスでも、プロキシする前にこれを呼ぶ。
+func CheckSite(req Request, site *Site) Decision {
+	if !site.AllowsMethod(req.Method) {
+		return MethodNotAllowed
+	}
+	if !site.allowsAddr(req.ClientIP) {
+		return NetworkDenied
+	}
+	return site.CheckTime(req.now())
+}
+
+// Snapshot は読み込んだ設定の一つの版。リロードと重なっても、一つのリクエストのサイト探しとアクセス判定は同じ版で行う。
+type Snapshot struct {
+	list *SettingList
+}
+
+// Current は現在の設定を返す。
+func Current() Snapshot {
+	return Snapshot{list: &loaded().list}
+}
+
+// SiteConfig はリクエストにマッチするサイトを返す。
+func (s Snapshot) SiteConfig(requestUrl url.URL) (*Site, error) {
+	site, err := findMatchSite(requestUrl, *s.list)
+	if err != nil {
+		log.Println("対応するサイトがない")
+		return nil, err
+	}
+
+	return site, nil
+}
+
+func CalculateListHash() string {
+	return loaded().hash
+}
+
+// allows はロールと require の両方を満たすかどうかを返す。
+// どちらも書かれていないサイトには誰もアクセスできない。
+func (site *Site) allows(method string, id Identity) bool {
+	ok, _ := site.checkIdentity(method, id)
+	return ok
+}
+
+// checkIdentity は allows の判定とその理由を返す。
+func (site *Site) checkIdentity(method string, id Identity) (bool, string) {
+	required := site.RolesFor(method)
+	if len(required) == 0 && site.require == nil {
+		return false, "roles も require も設定されていない"
+	}
+
+	if len(required) > 0 && !hasAnyRole(required, id.Roles) {
+		return false, fmt.Sprintf("%s に必要なロール %v のいずれも持っていない", method, required)
+	}
+
+	if site.require != nil {
+		ok, err := evalBool(site.require, id.Claims)
+		if err != nil {
+			log.Println("require の評価に失敗", site.ID, err)
+			return false, fmt.Sprintf("require の評価に失敗: %s", err)
+		}
+		if !ok {
+			return false, "require が false になった"
+		}
+	}
+	return true, "ロールと require を満たしている"
+}
+func hasAnyRole(required []string, roles []string) bool {
+	for _, role := range roles {
+		if slices.Contains(required, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// findMatchSiteIndex はリクエストにマッチするサイトのうち、最も具体的なものを返す。
+// ホストの具体性を先に比べ、同じならパスの具体性を比べる。どちらも同じなら先に書かれたものを優先する。
 func findMatchSiteIndex(target url.URL, list SettingList) (int, error) {
+	found := -1
+	bestHost, bestPath := 0, 0
 	for i, site := range list.Sites {
-		if target.Host != site.Host {
+		ok, hostScore := matchHost(site.Host, target.Host)
+		if !ok {
 			continue
 		}
-		if !strings.HasPrefix(target.Path, site.PathPrefix) {
+		ok, pathScore := site.path.match(target.Path)
+		if !ok {
 			continue
 		}
-		return i, nil
+		better := hostScore > bestHost || (hostScore == bestHost && pathScore > bestPath)
+		if found < 0 || better {
+			found = i
+			bestHost, bestPath = hostScore, pathScore
+		}
 	}
 
-	return 0, errors.New("not found")
+	if found < 0 {
+		return 0, errors.New("not found")
+	}
+	return found, nil
 }
 
 func findMatchSite(target url.URL, list SettingList) (*Site, error) {
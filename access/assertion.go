@@ -0,0 +1,50 @@
+package access
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// assertion を書いたサイトには、ユーザーの情報を署名した JWT をヘッダーで送る。
+// バックエンドは /__idproxy/jwks.json の公開鍵で検証し、aud がサイトの ID と一致することを確かめる。
+// 署名する鍵は ASSERTION_KEY_PATH で指定する。指定せずに assertion を書くと、設定の読み込みに失敗する。
+
+const (
+	DefaultAssertionHeader = "X-Idproxy-Assertion"
+	defaultAssertionTTL    = 5 * time.Minute
+)
+
+var ErrInvalidAssertion = errors.New("invalid assertion")
+
+type Assertion struct {
+	// Header は JWT を入れるヘッダーの名前
+	Header string `yaml:"header"`
+	// TTL は JWT の有効期間
+	TTL time.Duration `yaml:"ttl"`
+	// PerSession を true にすると、リクエストごとに署名せず、有効期間内は同じセッションで同じ JWT を使い回す
+	PerSession bool `yaml:"perSession"`
+}
+
+func compileAssertion(site *Site) error {
+	a := site.Assertion
+	if a == nil {
+		return nil
+	}
+	if a.Header == "" {
+		a.Header = DefaultAssertionHeader
+	}
+	if strings.ContainsAny(a.Header, " \t:\r\n") {
+		return fmt.Errorf("%w: %q", ErrInvalidHeaderName, a.Header)
+	}
+	a.Header = textproto.CanonicalMIMEHeaderKey(a.Header)
+	if a.TTL < 0 {
+		return fmt.Errorf("%w: ttl must be positive", ErrInvalidAssertion)
+	}
+	if a.TTL == 0 {
+		a.TTL = defaultAssertionTTL
+	}
+	return nil
+}
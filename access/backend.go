@@ -0,0 +1,147 @@
+package access
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// backend と backends はどちらか一方だけ書く。backends を書いた場合は balance で振り分ける。
+//
+//   - roundRobin: 順番に振り分ける (デフォルト)
+//   - leastConn: 処理中のリクエストが最も少ないバックエンドに振り分ける
+//   - hash: ユーザーの sub ごとに同じバックエンドに振り分ける。ログインしていない場合はクライアントの IP アドレスを使う
+//
+// healthCheck を書いた場合は定期的にバックエンドにリクエストし、2xx と 3xx 以外を返したものには振り分けない。
+// また、接続に maxFails 回続けて失敗したバックエンドは failTimeout の間振り分けない。ただし、ほかに振り分けられるバックエンドがない場合は外さない。
+// maxFails を省略した場合、backends が複数あるサイトでは 1 回の失敗で外し、バックエンドが一つのサイトでは外さない。
+//
+// transport ではバックエンドへの接続のタイムアウトと keep-alive を調整できる。同じ値のサイトは接続を共有する。
+
+type Balance string
+
+const (
+	BalanceRoundRobin Balance = "roundRobin"
+	BalanceLeastConn  Balance = "leastConn"
+	BalanceHash       Balance = "hash"
+)
+
+type HealthCheck struct {
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// Transport はバックエンドへの接続の設定。0 の項目はデフォルト値を使う。
+type Transport struct {
+	DialTimeout time.Duration `yaml:"dialTimeout"`
+	// ResponseHeaderTimeout はレスポンスヘッダーを待つ時間。デフォルトでは無制限に待つ
+	ResponseHeaderTimeout time.Duration `yaml:"responseHeaderTimeout"`
+	IdleConnTimeout       time.Duration `yaml:"idleConnTimeout"`
+	MaxIdleConnsPerHost   int           `yaml:"maxIdleConnsPerHost"`
+}
+
+var (
+	ErrBackendConflict  = errors.New("backend and backends cannot be used together")
+	ErrInvalidBalance   = errors.New("balance must be one of roundRobin, leastConn and hash")
+	ErrInvalidHealth    = errors.New("invalid healthCheck")
+	ErrInvalidTransport = errors.New("invalid transport")
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 2 * time.Second
+	defaultMaxFails       = 1
+	defaultFailTimeout    = 10 * time.Second
+
+	defaultDialTimeout         = 5 * time.Second
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultMaxIdleConnsPerHost = 32
+)
+
+func compileBackends(site *Site) error {
+	if site.Backend != "" && len(site.Backends) > 0 {
+		return ErrBackendConflict
+	}
+
+	if len(site.Backends) == 0 {
+		backend, err := expandEnv(site.Backend)
+		if err != nil {
+			return err
+		}
+		site.Backend = backend
+		if err := validateBackend(site.Backend); err != nil {
+			return err
+		}
+	}
+	for i, b := range site.Backends {
+		backend, err := expandEnv(b)
+		if err != nil {
+			return err
+		}
+		if err := validateBackend(backend); err != nil {
+			return err
+		}
+		site.Backends[i] = backend
+	}
+
+	switch site.Balance {
+	case "":
+		site.Balance = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConn, BalanceHash:
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidBalance, site.Balance)
+	}
+
+	if hc := site.HealthCheck; hc != nil {
+		if !strings.HasPrefix(hc.Path, "/") {
+			return fmt.Errorf("%w: path must start with /: %q", ErrInvalidHealth, hc.Path)
+		}
+		if hc.Interval == 0 {
+			hc.Interval = defaultHealthInterval
+		}
+		if hc.Timeout == 0 {
+			hc.Timeout = defaultHealthTimeout
+		}
+		if hc.Interval < 0 || hc.Timeout < 0 {
+			return fmt.Errorf("%w: interval and timeout must be positive", ErrInvalidHealth)
+		}
+	}
+
+	if site.MaxFails < 0 || site.FailTimeout < 0 {
+		return fmt.Errorf("%w: maxFails and failTimeout must not be negative", ErrInvalidHealth)
+	}
+	if site.MaxFails == 0 && len(site.Backends) > 1 {
+		site.MaxFails = defaultMaxFails
+	}
+	if site.FailTimeout == 0 {
+		site.FailTimeout = defaultFailTimeout
+	}
+
+	if site.Transport == nil {
+		site.Transport = &Transport{}
+	}
+	t := site.Transport
+	if t.DialTimeout < 0 || t.ResponseHeaderTimeout < 0 || t.IdleConnTimeout < 0 || t.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("%w: values must not be negative", ErrInvalidTransport)
+	}
+	if t.DialTimeout == 0 {
+		t.DialTimeout = defaultDialTimeout
+	}
+	if t.IdleConnTimeout == 0 {
+		t.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if t.MaxIdleConnsPerHost == 0 {
+		t.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	return nil
+}
+
+// BackendURLs はサイトのバックエンドの URL をすべて返す。
+func (site *Site) BackendURLs() []string {
+	if len(site.Backends) > 0 {
+		return site.Backends
+	}
+	return []string{site.Backend}
+}
@@ -0,0 +1,289 @@
+package access
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// 設定は 1 つのファイルか、conf.d のようなディレクトリから読み込む。
+// ディレクトリの場合は直下の .yml / .yaml / .json / .toml をファイル名順に読み、sites と denies はその順に、trustedProxies は和集合としてまとめる。
+// 同じ id や同じ host とパスの組み合わせのサイトが複数のファイルにある場合はエラーにする。
+//
+// backend には ${NAME} の形で環境変数を書ける。存在しない環境変数はエラーにする。
+
+type listFile struct {
+	name    string
+	content []byte
+}
+
+// position は設定の項目がどのファイルの何行目に書かれていたか
+type position struct {
+	file string
+	line int
+}
+
+func (p position) String() string {
+	if p.file == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", p.file, p.line)
+}
+
+var listExtensions = []string{".yml", ".yaml", ".json", ".toml"}
+
+// readListFiles は path がファイルならそれを、ディレクトリなら直下の設定ファイルを読む。
+func readListFiles(path string) ([]listFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return []listFile{{name: path, content: b}}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []listFile
+	for _, e := range entries {
+		// ConfigMap をマウントすると ..data のような隠しディレクトリができる
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if !isListFile(e.Name()) {
+			continue
+		}
+
+		name := filepath.Join(path, e.Name())
+		// シンボリックリンクの先がディレクトリのこともある
+		if info, err := os.Stat(name); err != nil || info.IsDir() {
+			continue
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, listFile{name: name, content: b})
+	}
+	return files, nil
+}
+
+func isListFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, v := range listExtensions {
+		if ext == v {
+			return true
+		}
+	}
+	return false
+}
+
+func hashFiles(files []listFile) string {
+	h := sha256.New()
+	for _, f := range files {
+		h.Write([]byte(f.name))
+		h.Write([]byte{0})
+		h.Write(f.content)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fileError はファイルのデコードに失敗したときのエラー
+type fileError struct {
+	file string
+	err  error
+}
+
+func (e *fileError) Error() string {
+	return fmt.Sprintf("%s: %s", e.file, e.err)
+}
+
+func (e *fileError) Unwrap() error {
+	return e.err
+}
+
+// decodeFiles はファイルをデコードしてまとめる。デコードに失敗したファイルがあっても、残りのファイルはまとめる。
+func decodeFiles(files []listFile) (*SettingList, []error) {
+	var merged SettingList
+	var errs []error
+
+	trusted := make(map[string]bool)
+	for _, f := range files {
+		l, err := decodeFile(f)
+		if err != nil {
+			errs = append(errs, &fileError{file: f.name, err: err})
+			var typeErr *yaml.TypeError
+			if !errors.As(err, &typeErr) {
+				continue
+			}
+		}
+
+		if err := mergeShared(&merged, l); err != nil {
+			errs = append(errs, &fileError{file: f.name, err: err})
+		}
+		merged.Sites = append(merged.Sites, l.Sites...)
+		merged.Denies = append(merged.Denies, l.Denies...)
+		for _, v := range l.TrustedProxies {
+			if !trusted[v] {
+				trusted[v] = true
+				merged.TrustedProxies = append(merged.TrustedProxies, v)
+			}
+		}
+	}
+	return &merged, errs
+}
+
+// mergeShared はすべてのファイルで共有する roleGroups、templates、defaults をまとめる。
+func mergeShared(merged *SettingList, l *SettingList) error {
+	for name, members := range l.RoleGroups {
+		if _, ok := merged.RoleGroups[name]; ok {
+			return fmt.Errorf("roleGroups %s が他のファイルでも定義されている", name)
+		}
+		if merged.RoleGroups == nil {
+			merged.RoleGroups = make(map[string][]string)
+		}
+		merged.RoleGroups[name] = members
+	}
+
+	for name, t := range l.Templates {
+		if other, ok := merged.Templates[name]; ok {
+			return fmt.Errorf("templates %s が %s でも定義されている", name, other.pos)
+		}
+		if merged.Templates == nil {
+			merged.Templates = make(map[string]Site)
+		}
+		merged.Templates[name] = t
+	}
+
+	if l.Defaults != nil {
+		if merged.Defaults != nil {
+			return fmt.Errorf("defaults が %s でも定義されている", merged.Defaults.pos)
+		}
+		merged.Defaults = l.Defaults
+	}
+	return nil
+}
+
+// decodeFile は拡張子に応じてファイルをデコードし、各項目に位置を記録する。
+func decodeFile(f listFile) (*SettingList, error) {
+	content := f.content
+
+	isToml := strings.ToLower(filepath.Ext(f.name)) == ".toml"
+	if isToml {
+		// 検証を YAML と共通にするため、一度 YAML に変換する
+		var m map[string]any
+		if _, err := toml.Decode(string(content), &m); err != nil {
+			return nil, err
+		}
+		b, err := yaml.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		content = b
+	}
+
+	// JSON は YAML としてそのまま読める
+	l, err := decodeList(string(content))
+
+	var root yaml.Node
+	yaml.Unmarshal(content, &root)
+
+	lineOf := func(node *yaml.Node) int {
+		if isToml {
+			return 0
+		}
+		return node.Line
+	}
+
+	for i, node := range sequenceItems(&root, "sites") {
+		if i < len(l.Sites) {
+			l.Sites[i].pos = position{file: f.name, line: lineOf(node)}
+			l.Sites[i].setFields = mappingKeys(node)
+		}
+	}
+	for i, node := range sequenceItems(&root, "denies") {
+		if i < len(l.Denies) {
+			l.Denies[i].pos = position{file: f.name, line: lineOf(node)}
+		}
+	}
+	if node := topLevel(&root, "defaults"); node != nil && l.Defaults != nil {
+		l.Defaults.pos = position{file: f.name, line: lineOf(node)}
+		l.Defaults.setFields = mappingKeys(node)
+	}
+	if node := topLevel(&root, "templates"); node != nil && node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			name := node.Content[i].Value
+			t, ok := l.Templates[name]
+			if !ok {
+				continue
+			}
+			t.pos = position{file: f.name, line: lineOf(node.Content[i+1])}
+			t.setFields = mappingKeys(node.Content[i+1])
+			l.Templates[name] = t
+		}
+	}
+
+	return l, err
+}
+
+// topLevel はトップレベルのマッピングから key の値を返す。
+func topLevel(root *yaml.Node, key string) *yaml.Node {
+	if len(root.Content) == 0 {
+		return nil
+	}
+	m := root.Content[0]
+	if m.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// sequenceItems はトップレベルの key の値 (シーケンス) の要素を返す。
+func sequenceItems(root *yaml.Node, key string) []*yaml.Node {
+	node := topLevel(root, key)
+	if node == nil || node.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return node.Content
+}
+
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+var ErrUndefinedEnv = errors.New("undefined environment variable")
+
+// expandEnv は ${NAME} を環境変数の値に置き換える。
+func expandEnv(v string) (string, error) {
+	var err error
+	r := envPattern.ReplaceAllStringFunc(v, func(m string) string {
+		name := envPattern.FindStringSubmatch(m)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			err = fmt.Errorf("%w: %s", ErrUndefinedEnv, name)
+		}
+		return value
+	})
+	return r, err
+}
@@ -0,0 +1,78 @@
+package access
+
+import (
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// denies にはサイトの設定によらずアクセスを拒否するリクエストを書く。
+// 広く公開しているサイトの一部のパスだけを閉じるのに使う。
+//
+// アクセス判定は次の順で行う。
+//
+//  1. リクエストにマッチするサイトを探す (見つからなければ拒否)
+//  2. サイトの methods に含まれないメソッドは 405
+//  3. サイトの allowCIDRs / denyCIDRs で接続元を判定する
+//  4. サイトの notBefore / notAfter / schedules で公開期間を判定する
+//  5. denies のいずれかにマッチし、exceptRoles のロールを持っていなければ拒否 (サイトの roles や require、公開設定より優先する)
+//  6. サイトの roles と require で判定する。ただし public と optional のパスで deny のためにログインを求めた場合は、
+//     5 で除外されたユーザーをそのまま通す
+type Deny struct {
+	Host       string `yaml:"host"`
+	PathPrefix string `yaml:"pathPrefix"`
+	PathGlob   string `yaml:"pathGlob"`
+	PathRegex  string `yaml:"pathRegex"`
+	// Methods を書いた場合、そのメソッドだけを拒否する
+	Methods []string `yaml:"methods"`
+	// ExceptRoles のいずれかのロールを持つユーザーは拒否しない
+	ExceptRoles []string `yaml:"exceptRoles"`
+
+	path *pathMatcher
+	pos  position
+}
+
+func compileDeny(d *Deny) error {
+	if err := validateHostPattern(d.Host); err != nil {
+		return err
+	}
+
+	m, err := compilePathMatcher(d.PathPrefix, d.PathGlob, d.PathRegex)
+	if err != nil {
+		return err
+	}
+	d.path = m
+
+	for i := range d.Methods {
+		d.Methods[i] = strings.ToUpper(d.Methods[i])
+	}
+	return nil
+}
+
+// matchDenies はリクエストにマッチする deny をすべて返す。
+func matchDenies(req Request, list SettingList) []*Deny {
+	var r []*Deny
+	for i, d := range list.Denies {
+		if ok, _ := matchHost(d.Host, req.URL.Host); !ok {
+			continue
+		}
+		if ok, _ := d.path.match(req.URL.Path); !ok {
+			continue
+		}
+		if len(d.Methods) > 0 && !slices.Contains(d.Methods, req.Method) {
+			continue
+		}
+		r = append(r, &list.Denies[i])
+	}
+	return r
+}
+
+// isDenied は、マッチする deny のうち 1 つでも exceptRoles で除外されないものがあれば true を返す。
+func isDenied(req Request, id Identity, list SettingList) bool {
+	for _, d := range matchDenies(req, list) {
+		if !hasAnyRole(d.ExceptRoles, id.Roles) {
+			return true
+		}
+	}
+	return false
+}
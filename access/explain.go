@@ -0,0 +1,206 @@
+package access
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Explanation はアクセス判定の過程
+type Explanation struct {
+	// 判定の対象になったサイト
+	Candidates []Candidate `json:"candidates"`
+	Site       string      `json:"site,omitempty"`
+	Extends    string      `json:"extends,omitempty"`
+	Backend    string      `json:"backend,omitempty"`
+	// パスを書き換える場合の、バックエンドに送るパス
+	BackendPath string `json:"backendPath,omitempty"`
+	// roleGroups を展開したあとの、サイトに必要なロール
+	Roles    []string `json:"roles,omitempty"`
+	AuthMode AuthMode `json:"authMode,omitempty"`
+	Steps    []Step   `json:"steps"`
+	Decision Decision `json:"decision"`
+	Reason   string   `json:"reason"`
+}
+
+type Candidate struct {
+	Index     int    `json:"index"`
+	ID        string `json:"id"`
+	Matched   bool   `json:"matched"`
+	Selected  bool   `json:"selected"`
+	HostScore int    `json:"hostScore,omitempty"`
+	PathScore int    `json:"pathScore,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+type Step struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// Explain は CanAccess と同じ順でアクセス判定を行い、その過程を返す。
+// id が nil の場合は未ログインのリクエストとして判定する。
+func Explain(req Request, id *Identity) Explanation {
+	list := loaded().list
+	var e Explanation
+
+	for i := range list.Sites {
+		site := &list.Sites[i]
+		c := Candidate{Index: i, ID: site.ID}
+
+		hostOK, hostScore := matchHost(site.Host, req.URL.Host)
+		pathOK, pathScore := site.path.match(req.URL.Path)
+		switch {
+		case !hostOK:
+			c.Reason = fmt.Sprintf("host %s にマッチしない", site.Host)
+		case !pathOK:
+			c.Reason = "パスにマッチしない"
+		default:
+			c.Matched = true
+			c.HostScore, c.PathScore = hostScore, pathScore
+			c.Reason = "マッチした"
+		}
+		e.Candidates = append(e.Candidates, c)
+	}
+
+	i, err := findMatchSiteIndex(req.URL, list)
+	if err != nil {
+		return e.finish(Denied, "リクエストにマッチするサイトがない")
+	}
+	site := &list.Sites[i]
+	e.Candidates[i].Selected = true
+	e.Candidates[i].Reason = "最も具体的なサイトとして選ばれた"
+	for j := range e.Candidates {
+		if e.Candidates[j].Matched && !e.Candidates[j].Selected {
+			e.Candidates[j].Reason = "マッチしたが、より具体的なサイトか先に書かれたサイトが優先された"
+		}
+	}
+	e.Site = site.ID
+	e.Extends = site.Extends
+	e.Backend = strings.Join(site.BackendURLs(), ", ")
+	if site.RewritesPath() {
+		e.BackendPath = site.BackendPath(req.URL.Path)
+	}
+	e.Roles = site.RolesFor(req.Method)
+
+	if !site.AllowsMethod(req.Method) {
+		e.step("method", false, fmt.Sprintf("%s は methods %v に含まれない", req.Method, site.Methods))
+		return e.finish(MethodNotAllowed, "メソッドが許可されていない")
+	}
+	e.step("method", true, req.Method)
+
+	if !site.allowsAddr(req.ClientIP) {
+		e.step("network", false, fmt.Sprintf("%s は allowCIDRs %v / denyCIDRs %v で許可されない", req.ClientIP, site.AllowCIDRs, site.DenyCIDRs))
+		return e.finish(NetworkDenied, "接続元のネットワークが許可されていない")
+	}
+	if req.ClientIP.IsValid() {
+		e.step("network", true, req.ClientIP.String())
+	} else {
+		e.step("network", true, "接続元は不明")
+	}
+
+	now := req.now()
+	if d := site.CheckTime(now); d != Allowed {
+		e.step("time", false, fmt.Sprintf("%s は公開期間外 (%s)", now.Format(time.RFC3339), d))
+		return e.finish(d, "公開期間外")
+	}
+	e.step("time", true, now.Format(time.RFC3339))
+
+	e.AuthMode = authModeFor(req, site, list)
+	e.step("auth", true, string(e.AuthMode))
+	if e.AuthMode == AuthPublic {
+		return e.finish(Allowed, "ログインなしで公開されている")
+	}
+
+	if id == nil {
+		if e.AuthMode == AuthOptional {
+			return e.finish(Allowed, "未ログインのままプロキシする")
+		}
+		return e.finish(Denied, "ログインが必要 (ログインページにリダイレクトされる)")
+	}
+
+	denied := false
+	for _, d := range matchDenies(req, list) {
+		exempt := hasAnyRole(d.ExceptRoles, id.Roles)
+		detail := fmt.Sprintf("host %s の deny にマッチした", d.Host)
+		if exempt {
+			detail += fmt.Sprintf("が、exceptRoles %v により除外された", d.ExceptRoles)
+		}
+		e.step("deny", exempt, detail)
+		denied = denied || !exempt
+	}
+
+	ok, reason := site.checkIdentity(req.Method, *id)
+	if !denied && !ok && loginRequiredOnlyByDeny(req, site, list) {
+		ok, reason = true, "deny のためだけにログインを求めたので、exceptRoles で除外されていれば通す"
+	}
+	if !denied {
+		e.step("identity", ok, reason)
+	}
+
+	if denied || !ok {
+		if e.AuthMode == AuthOptional {
+			return e.finish(Allowed, "権限はないが、optional なので未ログインとしてプロキシする")
+		}
+		if denied {
+			return e.finish(Denied, "deny にマッチした")
+		}
+		return e.finish(Denied, reason)
+	}
+	return e.finish(Allowed, reason)
+}
+
+func (e *Explanation) step(name string, ok bool, detail string) {
+	e.Steps = append(e.Steps, Step{Name: name, OK: ok, Detail: detail})
+}
+
+func (e *Explanation) finish(d Decision, reason string) Explanation {
+	e.Decision = d
+	e.Reason = reason
+	return *e
+}
+
+// String は人が読むための形式で判定の過程を返す。
+func (e Explanation) String() string {
+	var b strings.Builder
+
+	b.WriteString("sites:\n")
+	for _, c := range e.Candidates {
+		mark := " "
+		if c.Selected {
+			mark = "*"
+		}
+		fmt.Fprintf(&b, "  %s [%d] %s: %s", mark, c.Index, c.ID, c.Reason)
+		if c.Matched {
+			fmt.Fprintf(&b, " (host %d, path %d)", c.HostScore, c.PathScore)
+		}
+		b.WriteString("\n")
+	}
+
+	if e.Site != "" {
+		fmt.Fprintf(&b, "site: %s\n", e.Site)
+		if e.Extends != "" {
+			fmt.Fprintf(&b, "extends: %s\n", e.Extends)
+		}
+		fmt.Fprintf(&b, "backend: %s\n", e.Backend)
+		if e.BackendPath != "" {
+			fmt.Fprintf(&b, "backend path: %s\n", e.BackendPath)
+		}
+		fmt.Fprintf(&b, "roles: %s\n", strings.Join(e.Roles, ", "))
+	}
+
+	if len(e.Steps) > 0 {
+		b.WriteString("steps:\n")
+		for _, s := range e.Steps {
+			result := "ok"
+			if !s.OK {
+				result = "NG"
+			}
+			fmt.Fprintf(&b, "  %s: %s: %s\n", s.Name, result, s.Detail)
+		}
+	}
+
+	fmt.Fprintf(&b, "decision: %s (%s)\n", e.Decision, e.Reason)
+	return b.String()
+}
@@ -0,0 +1,606 @@
+package access
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/exp/slices"
+)
+
+// require には ID Token のクレームを参照する式を書ける。式は設定の読み込み時にコンパイルし、リクエストごとに評価する。
+// 構文は CEL のサブセットで、次のものが使える。
+//
+//   - クレーム名 (sub, email, roles, ...) と claims["name-with-dash"]、a.b によるメンバーアクセス
+//   - 文字列、数値、true / false / null、[a, b] のリスト
+//   - ! && || == != < <= > >= in (リストの要素か、マップのキーに含まれるか)
+//   - メソッド: startsWith, endsWith, contains, matches (RE2), size
+//     matches の正規表現は文字列リテラルで書いた場合だけ読み込み時にコンパイルする。それ以外は評価のたびにコンパイルする
+//
+// 存在しないクレームは null になる。型が合わないなどで評価に失敗した場合はアクセスを拒否する。
+
+var ErrInvalidExpression = errors.New("invalid require expression")
+
+type expr func(claims map[string]any) (any, error)
+
+// compileExpr は式をコンパイルする。
+func compileExpr(src string) (expr, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidExpression, err)
+	}
+
+	p := &exprParser{tokens: tokens}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidExpression, err)
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidExpression, p.peek().text)
+	}
+	return e, nil
+}
+
+// evalBool は式を評価し、true になったかどうかを返す。
+func evalBool(e expr, claims map[string]any) (bool, error) {
+	v, err := e(claims)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression result is not bool: %v", v)
+	}
+	return b, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			s, n, err := readString(src[i:])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenString, text: s})
+			i += n
+		case '0' <= c && c <= '9':
+			j := i
+			for j < len(src) && (('0' <= src[j] && src[j] <= '9') || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: src[i:j]})
+			i = j
+		case isIdentStart(src[i:]):
+			j := i
+			for j < len(src) {
+				r, n := utf8.DecodeRuneInString(src[j:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				j += n
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: src[i:j]})
+			i = j
+		default:
+			found := false
+			for _, p := range []string{"&&", "||", "==", "!=", "<=", ">=", "!", "<", ">", "(", ")", "[", "]", ",", "."} {
+				if strings.HasPrefix(src[i:], p) {
+					tokens = append(tokens, token{kind: tokenPunct, text: p})
+					i += len(p)
+					found = true
+					break
+				}
+			}
+			if !found {
+				r, _ := utf8.DecodeRuneInString(src[i:])
+				return nil, fmt.Errorf("unexpected character %q", r)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF}), nil
+}
+
+// isIdentStart は src が識別子で始まるかどうかを返す。クレーム名に ASCII 以外の文字も使えるように、1 バイトずつではなく文字単位で見る。
+func isIdentStart(src string) bool {
+	r, _ := utf8.DecodeRuneInString(src)
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func readString(src string) (string, int, error) {
+	quote := src[0]
+	var b strings.Builder
+	for i := 1; i < len(src); i++ {
+		c := src[i]
+		switch c {
+		case quote:
+			return b.String(), i + 1, nil
+		case '\\':
+			if i+1 >= len(src) {
+				return "", 0, errors.New("unterminated string")
+			}
+			i++
+			switch src[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(src[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errors.New("unterminated string")
+}
+
+type exprParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) accept(text string) bool {
+	t := p.peek()
+	if (t.kind == tokenPunct || t.kind == tokenIdent) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(text string) error {
+	if !p.accept(text) {
+		return fmt.Errorf("expected %q but got %q", text, p.peek().text)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		l := left
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = func(c map[string]any) (any, error) {
+			lv, err := evalBool(l, c)
+			if err != nil {
+				return nil, err
+			}
+			if lv {
+				return true, nil
+			}
+			return evalBool(r, c)
+		}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		l := left
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = func(c map[string]any) (any, error) {
+			lv, err := evalBool(l, c)
+			if err != nil {
+				return nil, err
+			}
+			if !lv {
+				return false, nil
+			}
+			return evalBool(r, c)
+		}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (expr, error) {
+	if p.accept("!") {
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(c map[string]any) (any, error) {
+			v, err := evalBool(e, c)
+			if err != nil {
+				return nil, err
+			}
+			return !v, nil
+		}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (expr, error) {
+	left, err := p.parsePostfix()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if !p.accept(op) {
+			continue
+		}
+		right, err := p.parsePostfix()
+		if err != nil {
+			return nil, err
+		}
+		return func(c map[string]any) (any, error) {
+			lv, err := left(c)
+			if err != nil {
+				return nil, err
+			}
+			rv, err := right(c)
+			if err != nil {
+				return nil, err
+			}
+			return compare(op, lv, rv)
+		}, nil
+	}
+	return left, nil
+}
+
+func (p *exprParser) parsePostfix() (expr, error) {
+	e, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch {
+		case p.accept("."):
+			name := p.next()
+			if name.kind != tokenIdent {
+				return nil, fmt.Errorf("expected name after '.' but got %q", name.text)
+			}
+			if p.accept("(") {
+				start := p.pos
+				args, err := p.parseArgs(")")
+				if err != nil {
+					return nil, err
+				}
+				e, err = compileMethod(e, name.text, args, p.tokens[start:p.pos])
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			e = member(e, func(map[string]any) (any, error) { return name.text, nil })
+		case p.accept("["):
+			key, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			e = member(e, key)
+		default:
+			return e, nil
+		}
+	}
+}
+
+func (p *exprParser) parseArgs(end string) ([]expr, error) {
+	var args []expr
+	if p.accept(end) {
+		return args, nil
+	}
+	for {
+		a, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+		if p.accept(end) {
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parsePrimary() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return constant(t.text), nil
+	case tokenNumber:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t.text)
+		}
+		return constant(n), nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return constant(true), nil
+		case "false":
+			return constant(false), nil
+		case "null":
+			return constant(nil), nil
+		case "claims":
+			return func(c map[string]any) (any, error) { return c, nil }, nil
+		}
+		return func(c map[string]any) (any, error) { return c[t.text], nil }, nil
+	case tokenPunct:
+		switch t.text {
+		case "(":
+			e, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return e, nil
+		case "[":
+			items, err := p.parseArgs("]")
+			if err != nil {
+				return nil, err
+			}
+			return func(c map[string]any) (any, error) {
+				l := make([]any, 0, len(items))
+				for _, item := range items {
+					v, err := item(c)
+					if err != nil {
+						return nil, err
+					}
+					l = append(l, v)
+				}
+				return l, nil
+			}, nil
+		}
+	}
+	if t.kind == tokenEOF {
+		return nil, errors.New("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+func constant(v any) expr {
+	return func(map[string]any) (any, error) { return v, nil }
+}
+
+// member は a.b と a[b] を評価する。null のメンバーは null になる。
+func member(target, key expr) expr {
+	return func(c map[string]any) (any, error) {
+		tv, err := target(c)
+		if err != nil {
+			return nil, err
+		}
+		kv, err := key(c)
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tv.(type) {
+		case nil:
+			return nil, nil
+		case map[string]any:
+			k, ok := kv.(string)
+			if !ok {
+				return nil, fmt.Errorf("map key must be string: %v", kv)
+			}
+			return t[k], nil
+		case []any:
+			n, ok := kv.(float64)
+			if !ok || n < 0 || int(n) >= len(t) {
+				return nil, fmt.Errorf("invalid list index: %v", kv)
+			}
+			return t[int(n)], nil
+		}
+		return nil, fmt.Errorf("cannot access member of %v", tv)
+	}
+}
+
+// argTokens は引数から閉じ括弧までのトークンで、matches の引数が文字列リテラルかどうかを見るのに使う。
+func compileMethod(target expr, name string, args []expr, argTokens []token) (expr, error) {
+	wantArgs := map[string]int{
+		"startsWith": 1,
+		"endsWith":   1,
+		"contains":   1,
+		"matches":    1,
+		"size":       0,
+	}
+	n, ok := wantArgs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown method %q", name)
+	}
+	if len(args) != n {
+		return nil, fmt.Errorf("%s takes %d arguments", name, n)
+	}
+
+	// 評価のたびに違う正規表現になりうる場合はキャッシュしない。クレームの値ごとにキャッシュすると際限なく増えてしまう
+	var literal *regexp.Regexp
+	if name == "matches" && len(argTokens) == 2 && argTokens[0].kind == tokenString {
+		re, err := regexp.Compile(argTokens[0].text)
+		if err != nil {
+			return nil, err
+		}
+		literal = re
+	}
+
+	return func(c map[string]any) (any, error) {
+		tv, err := target(c)
+		if err != nil {
+			return nil, err
+		}
+		var av any
+		if n == 1 {
+			av, err = args[0](c)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if name == "size" {
+			switch t := tv.(type) {
+			case string:
+				return float64(len(t)), nil
+			case []any:
+				return float64(len(t)), nil
+			case map[string]any:
+				return float64(len(t)), nil
+			}
+			return nil, fmt.Errorf("size of %v", tv)
+		}
+
+		if l, ok := tv.([]any); ok && name == "contains" {
+			return listContains(l, av), nil
+		}
+
+		s, ok1 := tv.(string)
+		a, ok2 := av.(string)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%s requires strings: %v, %v", name, tv, av)
+		}
+		switch name {
+		case "startsWith":
+			return strings.HasPrefix(s, a), nil
+		case "endsWith":
+			return strings.HasSuffix(s, a), nil
+		case "contains":
+			return strings.Contains(s, a), nil
+		}
+
+		if literal != nil {
+			return literal.MatchString(s), nil
+		}
+		re, err := regexp.Compile(a)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(s), nil
+	}, nil
+}
+
+func compare(op string, l, r any) (any, error) {
+	switch op {
+	case "==":
+		return equal(l, r), nil
+	case "!=":
+		return !equal(l, r), nil
+	case "in":
+		switch t := r.(type) {
+		case []any:
+			return listContains(t, l), nil
+		case map[string]any:
+			k, ok := l.(string)
+			if !ok {
+				return false, nil
+			}
+			_, ok = t[k]
+			return ok, nil
+		case nil:
+			return false, nil
+		}
+		return nil, fmt.Errorf("right side of in must be list or map: %v", r)
+	}
+
+	var c int
+	switch lv := l.(type) {
+	case float64:
+		rv, ok := r.(float64)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %v and %v", l, r)
+		}
+		switch {
+		case lv < rv:
+			c = -1
+		case lv > rv:
+			c = 1
+		}
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %v and %v", l, r)
+		}
+		c = strings.Compare(lv, rv)
+	default:
+		return nil, fmt.Errorf("cannot compare %v and %v", l, r)
+	}
+
+	switch op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	default:
+		return c >= 0, nil
+	}
+}
+
+func equal(l, r any) bool {
+	switch lv := l.(type) {
+	case []any:
+		rv, ok := r.([]any)
+		return ok && slices.EqualFunc(lv, rv, equal)
+	case map[string]any:
+		return false
+	}
+	switch r.(type) {
+	case []any, map[string]any:
+		return false
+	}
+	return l == r
+}
+
+func listContains(l []any, v any) bool {
+	for _, item := range l {
+		if equal(item, v) {
+			return true
+		}
+	}
+	return false
+}
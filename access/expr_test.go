@@ -0,0 +1,142 @@
+package access
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExpr(t *testing.T) {
+	claims := map[string]any{
+		"sub":            "user1",
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"age":            float64(20),
+		"roles":          []any{"admin", "dev"},
+		"groups":         []any{},
+		"address":        map[string]any{"country": "JP"},
+		"x-tenant":       "comame",
+		"pattern":        "^user[0-9]+$",
+		"badPattern":     "(",
+		"名前":             "太郎",
+		"ロール2":           "a",
+	}
+
+	tests := []struct {
+		src  string
+		want bool
+		// 評価に失敗する場合は true
+		evalErr bool
+	}{
+		// 優先順位
+		{src: "true || false && false", want: true},
+		{src: "(true || false) && false", want: false},
+		{src: "!true || true", want: true},
+		{src: "!(true || true)", want: false},
+		{src: "!!true", want: true},
+		{src: "age > 18 && age < 30", want: true},
+		{src: `sub == "user1" || email.endsWith("@other.com") && false`, want: true},
+		{src: `"admin" in roles && email_verified`, want: true},
+
+		// in
+		{src: `"admin" in roles`, want: true},
+		{src: `"guest" in roles`, want: false},
+		{src: `"admin" in groups`, want: false},
+		{src: `"country" in address`, want: true},
+		{src: `"city" in address`, want: false},
+		{src: `1 in address`, want: false},
+		{src: `"a" in missing`, want: false},
+		{src: `sub in ["user1", "user2"]`, want: true},
+		{src: `[1, 2] in [[1, 2]]`, want: true},
+		{src: `"a" in "abc"`, evalErr: true},
+
+		// null
+		{src: "missing == null", want: true},
+		{src: "sub != null", want: true},
+		{src: "missing.a.b == null", want: true},
+		{src: `claims["missing"] == null`, want: true},
+		{src: "missing", evalErr: true},
+		{src: "!missing", evalErr: true},
+		{src: "missing && true", evalErr: true},
+		{src: "false && missing", want: false},
+		{src: "true || missing", want: true},
+		{src: `missing.startsWith("a")`, evalErr: true},
+
+		// 型
+		{src: "age >= 20", want: true},
+		{src: `age == "20"`, want: false},
+		{src: `email_verified == "true"`, want: false},
+		{src: `age < "30"`, evalErr: true},
+		{src: "roles < 1", evalErr: true},
+		{src: `sub`, evalErr: true},
+		{src: "sub.x", evalErr: true},
+		{src: `address[1]`, evalErr: true},
+		{src: `roles[5] == "a"`, evalErr: true},
+		{src: `roles[0] == "admin"`, want: true},
+		{src: `address.country == "JP"`, want: true},
+		{src: `"b" < "c"`, want: true},
+		{src: `address == address`, want: false},
+
+		// メソッド
+		{src: `email.endsWith("@example.com")`, want: true},
+		{src: `email.startsWith("alice@")`, want: true},
+		{src: `email.contains("@")`, want: true},
+		{src: `roles.contains("dev")`, want: true},
+		{src: `email.matches("^[a-z]+@example\\.com$")`, want: true},
+		{src: `sub.matches(pattern)`, want: true},
+		{src: `email.matches(pattern)`, want: false},
+		{src: `sub.matches(missing)`, evalErr: true},
+		{src: `sub.matches(badPattern)`, evalErr: true},
+		{src: "roles.size() == 2", want: true},
+		{src: "sub.size() == 5", want: true},
+		{src: "address.size() == 1", want: true},
+		{src: "age.size() == 2", evalErr: true},
+		{src: `age.startsWith("2")`, evalErr: true},
+		{src: `claims["x-tenant"] == "comame"`, want: true},
+
+		// ASCII 以外の識別子
+		{src: `名前 == "太郎"`, want: true},
+		{src: `ロール2 == "a"`, want: true},
+		{src: `claims["名前"].startsWith("太")`, want: true},
+	}
+
+	for _, tt := range tests {
+		e, err := compileExpr(tt.src)
+		if err != nil {
+			t.Errorf("compileExpr(%q) error = %v", tt.src, err)
+			continue
+		}
+		got, err := evalBool(e, claims)
+		if (err != nil) != tt.evalErr {
+			t.Errorf("evalBool(%q) error = %v, want error %v", tt.src, err, tt.evalErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("evalBool(%q) = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestCompileExprError(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"sub ==",
+		"(sub",
+		"sub )",
+		`"abc`,
+		"sub @ email",
+		"roles[0",
+		"sub.",
+		"sub.1",
+		"1.2.3 == 1",
+		`sub.unknown()`,
+		`sub.startsWith()`,
+		`sub.size(1)`,
+		`sub.matches("(")`,
+		`sub.matches("a", "b")`,
+		"sub == 1 == 1",
+	} {
+		if _, err := compileExpr(src); !errors.Is(err, ErrInvalidExpression) {
+			t.Errorf("compileExpr(%q) error = %v, want %v", src, err, ErrInvalidExpression)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package access
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+// identityHeaders を書いたサイトには、ログインしているユーザーの情報をヘッダーで送る。
+// クライアントが同じ名前のヘッダーを送ってきても、サイトの設定によらず必ず取り除いてから転送する。
+// 別のサイトで設定した名前のヘッダーや、- を _ にした名前 (X_Forwarded_User) のヘッダーも取り除く。
+
+const (
+	DefaultUserHeader  = "X-Forwarded-User"
+	DefaultEmailHeader = "X-Forwarded-Email"
+	DefaultRolesHeader = "X-Forwarded-Roles"
+)
+
+var ErrInvalidHeaderName = errors.New("invalid header name")
+
+// IdentityHeaders はユーザーの情報を送るヘッダーの名前。省略した項目は X-Forwarded-* を使う。
+type IdentityHeaders struct {
+	// User には sub を入れる
+	User  string `yaml:"user"`
+	Email string `yaml:"email"`
+	// Roles にはロールをカンマ区切りで入れる
+	Roles string `yaml:"roles"`
+}
+
+func compileIdentityHeaders(site *Site) error {
+	h := site.IdentityHeaders
+	if h == nil {
+		return nil
+	}
+	for _, v := range []struct {
+		name *string
+		def  string
+	}{
+		{&h.User, DefaultUserHeader},
+		{&h.Email, DefaultEmailHeader},
+		{&h.Roles, DefaultRolesHeader},
+	} {
+		if *v.name == "" {
+			*v.name = v.def
+		}
+		if strings.ContainsAny(*v.name, " \t:\r\n") {
+			return fmt.Errorf("%w: %q", ErrInvalidHeaderName, *v.name)
+		}
+		*v.name = textproto.CanonicalMIMEHeaderKey(*v.name)
+	}
+	return nil
+}
+
+// IdentityHeaderNames はサイトがユーザーの情報を送るのに使うヘッダーの名前を返す。送らない場合もデフォルトの名前を返す。
+func (site *Site) IdentityHeaderNames() []string {
+	names := []string{DefaultUserHeader, DefaultEmailHeader, DefaultRolesHeader, DefaultAssertionHeader}
+	return append(names, site.SignedHeaderNames()...)
+}
@@ -0,0 +1,68 @@
+package access
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+var ErrInvalidHostPattern = errors.New("invalid host pattern")
+
+// host には完全一致のほか、先頭のラベルを * にしたワイルドカード (*.comame.xyz) を書ける。
+// * は 1 つ以上のラベルにマッチし、*.comame.xyz は comame.xyz 自体にはマッチしない。
+// ポートを書いた場合はポートも一致する必要があり、書かなかった場合はポートを問わない。
+//
+// 複数のサイトにマッチする場合は、完全一致 > より長いワイルドカード > ポート指定あり の順に優先する。
+
+func validateHostPattern(pattern string) error {
+	host, _ := splitHostPort(pattern)
+	if host == "" {
+		return ErrInvalidHostPattern
+	}
+
+	name := strings.TrimPrefix(host, "*.")
+	if strings.Contains(name, "*") {
+		return ErrInvalidHostPattern
+	}
+	return nil
+}
+
+// matchHost は pattern が host にマッチするかどうかと、マッチした場合の具体性を返す。
+// 具体性は値が大きいほど優先される。
+func matchHost(pattern, host string) (bool, int) {
+	ph, pp := splitHostPort(pattern)
+	th, tp := splitHostPort(host)
+
+	if pp != "" && pp != tp {
+		return false, 0
+	}
+	portScore := 0
+	if pp != "" {
+		portScore = 1
+	}
+
+	if wildcard, ok := strings.CutPrefix(ph, "*."); ok {
+		if !strings.HasSuffix(th, "."+wildcard) {
+			return false, 0
+		}
+		labels := strings.Count(wildcard, ".") + 1
+		return true, (labels*2)*2 + portScore
+	}
+
+	if ph != th {
+		return false, 0
+	}
+	labels := strings.Count(ph, ".") + 1
+	return true, (labels*2+1)*2 + portScore
+}
+
+func splitHostPort(hostport string) (host, port string) {
+	hostport = strings.ToLower(hostport)
+
+	h, p, err := net.SplitHostPort(hostport)
+	if err != nil {
+		// ポートが書かれていない
+		return strings.TrimSuffix(hostport, "."), ""
+	}
+	return strings.TrimSuffix(h, "."), p
+}
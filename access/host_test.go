@@ -0,0 +1,104 @@
+package access
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "EXAMPLE.com", true},
+		{"Example.COM", "example.com", true},
+		{"example.com", "example.com.", true},
+		{"example.com", "example.com:8080", true},
+		{"example.com", "www.example.com", false},
+		{"example.com", "example.org", false},
+
+		{"*.example.com", "a.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "aexample.com", false},
+		{"*.example.com", "a.example.com:8443", true},
+
+		{"example.com:8080", "example.com:8080", true},
+		{"example.com:8080", "example.com", false},
+		{"example.com:8080", "example.com:8081", false},
+		{"*.example.com:8080", "a.example.com:8080", true},
+		{"*.example.com:8080", "a.example.com", false},
+	}
+
+	for _, tt := range tests {
+		if got, _ := matchHost(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("matchHost(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestValidateHostPattern(t *testing.T) {
+	for _, pattern := range []string{"", "*", "a.*.example.com", "*example.com", "**.example.com", ":8080"} {
+		if err := validateHostPattern(pattern); !errors.Is(err, ErrInvalidHostPattern) {
+			t.Errorf("validateHostPattern(%q) error = %v, want %v", pattern, err, ErrInvalidHostPattern)
+		}
+	}
+	for _, pattern := range []string{"example.com", "*.example.com", "example.com:8080", "*.example.com:8080", "localhost"} {
+		if err := validateHostPattern(pattern); err != nil {
+			t.Errorf("validateHostPattern(%q) error = %v", pattern, err)
+		}
+	}
+}
+
+// 完全一致 > より長いワイルドカード > ポート指定あり の順に優先し、同じなら先に書かれたものを優先する
+func TestHostPrecedence(t *testing.T) {
+	l := mustParse(t, `
+sites:
+  - {id: wildcard, host: "*.example.com", auth: public, backend: "http://b"}
+  - {id: wildcard-port, host: "*.example.com:8080", auth: public, backend: "http://b"}
+  - {id: deep-wildcard, host: "*.a.example.com", auth: public, backend: "http://b"}
+  - {id: exact, host: a.example.com, auth: public, backend: "http://b"}
+  - {id: exact-port, host: "b.example.com:8080", auth: public, backend: "http://b"}
+  - {id: exact-no-port, host: b.example.com, auth: public, backend: "http://b"}
+`)
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"a.example.com", "exact"},
+		{"a.example.com:8080", "exact"},
+		{"x.a.example.com", "deep-wildcard"},
+		{"x.a.example.com:8080", "deep-wildcard"},
+		{"c.example.com", "wildcard"},
+		{"c.example.com:8080", "wildcard-port"},
+		{"b.example.com", "exact-no-port"},
+		{"b.example.com:8080", "exact-port"},
+		{"B.Example.Com.", "exact-no-port"},
+	}
+	for _, tt := range tests {
+		site, err := findMatchSite(url.URL{Host: tt.host, Path: "/"}, *l)
+		if err != nil {
+			t.Errorf("findMatchSite(%q) error = %v", tt.host, err)
+			continue
+		}
+		if site.ID != tt.want {
+			t.Errorf("findMatchSite(%q) = %s, want %s", tt.host, site.ID, tt.want)
+		}
+	}
+
+	if _, err := findMatchSite(url.URL{Host: "example.com", Path: "/"}, *l); err == nil {
+		t.Error("findMatchSite(example.com) should not match *.example.com")
+	}
+}
+
+func mustParse(t *testing.T, yml string) *SettingList {
+	t.Helper()
+	l, err := parseFiles([]listFile{{name: "list.yml", content: []byte(yml)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
@@ -0,0 +1,165 @@
+package access
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// Matrix はロールごとに、各サイトへどのメソッドでアクセスできるかをまとめたもの
+type Matrix struct {
+	Roles []string    `json:"roles"`
+	Rows  []MatrixRow `json:"rows"`
+}
+
+type MatrixRow struct {
+	Site string   `json:"site"`
+	Host string   `json:"host"`
+	Path string   `json:"path"`
+	Auth AuthMode `json:"auth"`
+	// ロールごとのアクセスできるメソッド。すべてのメソッドにアクセスできる場合は ["*"]
+	Access map[string][]string `json:"access"`
+	// ロール以外でアクセスが決まる条件
+	Conditions []string `json:"conditions,omitempty"`
+}
+
+var matrixMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// BuildMatrix は設定に出てくるすべてのロールとサイトの組み合わせについて、アクセスできるかを判定する。
+// ロールだけで判定できない条件 (require、接続元、公開期間、deny) は Conditions に書く。
+func BuildMatrix(list *SettingList) Matrix {
+	var m Matrix
+	m.Roles = listRoles(list)
+
+	for i := range list.Sites {
+		site := &list.Sites[i]
+		row := MatrixRow{
+			Site:   site.ID,
+			Host:   site.Host,
+			Path:   site.PathPrefix + site.PathGlob + site.PathRegex,
+			Auth:   site.Auth,
+			Access: make(map[string][]string),
+		}
+		if row.Path == "" {
+			row.Path = "/"
+		}
+
+		host, path, ok := samplePath(*site)
+		if ok {
+			if found, err := findMatchSiteIndex(url.URL{Host: host, Path: path}, *list); err != nil || found != i {
+				row.Conditions = append(row.Conditions, "より具体的なサイトに隠れている")
+			}
+		}
+		sample := Request{URL: url.URL{Host: host, Path: path}}
+
+		methods := site.Methods
+		if len(methods) == 0 {
+			methods = matrixMethods
+		}
+
+		for _, role := range m.Roles {
+			id := Identity{Roles: []string{role}}
+			allowed := []string{}
+			for _, method := range methods {
+				sample.Method = method
+				if authModeFor(sample, site, *list) == AuthPublic {
+					allowed = append(allowed, method)
+					continue
+				}
+				if isDenied(sample, id, *list) {
+					continue
+				}
+				if loginRequiredOnlyByDeny(sample, site, *list) {
+					allowed = append(allowed, method)
+					continue
+				}
+				if site.require != nil {
+					// require はロールだけでは判定できないので、ロールの条件だけを見て Conditions に書く
+					if roleCheckOnly(site, method, role) {
+						allowed = append(allowed, method)
+					}
+					continue
+				}
+				if site.allows(method, id) {
+					allowed = append(allowed, method)
+				}
+			}
+			if len(allowed) == len(methods) && len(site.Methods) == 0 {
+				allowed = []string{"*"}
+			}
+			row.Access[role] = allowed
+		}
+
+		row.Conditions = append(row.Conditions, siteConditions(site, list)...)
+		m.Rows = append(m.Rows, row)
+	}
+
+	return m
+}
+
+// roleCheckOnly は require を除いて、ロールの条件だけを満たすかどうかを返す。
+func roleCheckOnly(site *Site, method, role string) bool {
+	required := site.RolesFor(method)
+	return len(required) == 0 || slices.Contains(required, role)
+}
+
+func siteConditions(site *Site, list *SettingList) []string {
+	var c []string
+	if site.Require != "" {
+		c = append(c, "require: "+site.Require)
+	}
+	if len(site.PublicPaths) > 0 {
+		c = append(c, "publicPaths: "+strings.Join(site.PublicPaths, " "))
+	}
+	if len(site.AllowCIDRs) > 0 {
+		c = append(c, "allowCIDRs: "+strings.Join(site.AllowCIDRs, " "))
+	}
+	if len(site.DenyCIDRs) > 0 {
+		c = append(c, "denyCIDRs: "+strings.Join(site.DenyCIDRs, " "))
+	}
+	if site.NotBefore != nil {
+		c = append(c, "notBefore: "+site.NotBefore.String())
+	}
+	if site.NotAfter != nil {
+		c = append(c, "notAfter: "+site.NotAfter.String())
+	}
+	if len(site.Schedules) > 0 {
+		c = append(c, "schedules")
+	}
+
+	host, _, _ := samplePath(*site)
+	for _, d := range list.Denies {
+		if ok, _ := matchHost(d.Host, host); ok {
+			c = append(c, "deny: "+d.Host+d.PathPrefix+d.PathGlob+d.PathRegex)
+		}
+	}
+	return c
+}
+
+func listRoles(list *SettingList) []string {
+	seen := make(map[string]bool)
+	add := func(roles []string) {
+		for _, r := range roles {
+			seen[r] = true
+		}
+	}
+
+	for _, site := range list.Sites {
+		add(site.Roles)
+		for _, mr := range site.MethodRoles {
+			add(mr.Roles)
+		}
+	}
+	for _, d := range list.Denies {
+		add(d.ExceptRoles)
+	}
+
+	var roles []string
+	for r := range seen {
+		roles = append(roles, r)
+	}
+	sort.Strings(roles)
+	return roles
+}
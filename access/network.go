@@ -0,0 +1,101 @@
+package access
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// allowCIDRs を書いたサイトには、そのネットワークからしかアクセスできない。denyCIDRs は allowCIDRs より優先する。
+// クライアントの IP アドレスは、直前のホップが trustedProxies に含まれる場合に限り X-Forwarded-For から取る。
+
+var ErrInvalidCIDR = errors.New("invalid CIDR")
+
+func parseCIDRs(values []string) ([]netip.Prefix, error) {
+	var r []netip.Prefix
+	for _, v := range values {
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			// 単一のアドレスも書けるようにする
+			a, aerr := netip.ParseAddr(v)
+			if aerr != nil {
+				return nil, fmt.Errorf("%w: %s", ErrInvalidCIDR, v)
+			}
+			p = netip.PrefixFrom(a, a.BitLen())
+		}
+		r = append(r, p.Masked())
+	}
+	return r, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileNetwork(site *Site) error {
+	var err error
+	if site.allowCIDRs, err = parseCIDRs(site.AllowCIDRs); err != nil {
+		return err
+	}
+	if site.denyCIDRs, err = parseCIDRs(site.DenyCIDRs); err != nil {
+		return err
+	}
+	return nil
+}
+
+// allowsAddr はクライアントの IP アドレスからのアクセスを許すかどうかを返す。
+func (site *Site) allowsAddr(addr netip.Addr) bool {
+	if len(site.allowCIDRs) == 0 && len(site.denyCIDRs) == 0 {
+		return true
+	}
+	if !addr.IsValid() {
+		return false
+	}
+	if containsAddr(site.denyCIDRs, addr) {
+		return false
+	}
+	if len(site.allowCIDRs) > 0 && !containsAddr(site.allowCIDRs, addr) {
+		return false
+	}
+	return true
+}
+
+// ClientIP は接続元のアドレスと X-Forwarded-For ヘッダーから、クライアントの IP アドレスを求める。
+// 信頼できるプロキシを経由している間だけ X-Forwarded-For を右から辿り、最初に見つかった信頼できないアドレスを返す。
+func ClientIP(remoteAddr string, xff []string) netip.Addr {
+	addr, err := netip.ParseAddrPort(remoteAddr)
+	var client netip.Addr
+	if err == nil {
+		client = addr.Addr().Unmap()
+	} else if a, err := netip.ParseAddr(remoteAddr); err == nil {
+		client = a.Unmap()
+	} else {
+		return netip.Addr{}
+	}
+
+	trusted := loaded().list.trustedProxies
+
+	var hops []string
+	for _, v := range xff {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !containsAddr(trusted, client) {
+			break
+		}
+		a, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = a.Unmap()
+	}
+	return client
+}
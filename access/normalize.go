@@ -0,0 +1,127 @@
+package access
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+var ErrAmbiguousPath = errors.New("ambiguous request path")
+
+// CanonicalizeURL はリクエストのパスを正規化して u を書き換える。
+// 認可とバックエンドで同じパスを見るように、アクセス判定の前に呼び、正規化後のパスをそのままバックエンドに送る。
+//
+// 連続した / はまとめ、. と .. は解決する。バックエンドによって解釈が分かれるもの
+// (エンコードされた / や \、制御文字、二重エンコード、; を含むセグメント、ルートより上への ..、UTF-8 として不正なバイト列) は ErrAmbiguousPath を返す。
+// 大文字と小文字はそのまま残し、パスの照合で区別しない (path.go)。
+func CanonicalizeURL(u *url.URL) error {
+	p, err := canonicalizePath(u.EscapedPath())
+	if err != nil {
+		return err
+	}
+
+	u.Path = p
+	u.RawPath = ""
+	return nil
+}
+
+func canonicalizePath(escaped string) (string, error) {
+	if escaped == "" {
+		return "/", nil
+	}
+	if escaped[0] != '/' {
+		return "", ErrAmbiguousPath
+	}
+
+	decoded, err := decodePath(escaped)
+	if err != nil {
+		return "", err
+	}
+
+	var segments []string
+	for _, seg := range strings.Split(decoded, "/") {
+		// /admin;x/ や ..;/ のように、; 以降をパスパラメータとして捨てるバックエンドがある。
+		// 捨てた後のパスで照合し直すより、パスパラメータを使うサイトがないので拒否する
+		if strings.Contains(seg, ";") {
+			return "", ErrAmbiguousPath
+		}
+
+		switch seg {
+		case "", ".":
+			continue
+		case "..":
+			if len(segments) == 0 {
+				return "", ErrAmbiguousPath
+			}
+			segments = segments[:len(segments)-1]
+		default:
+			segments = append(segments, seg)
+		}
+	}
+
+	p := "/" + strings.Join(segments, "/")
+
+	last := decoded[strings.LastIndex(decoded, "/")+1:]
+	trailingSlash := last == "" || last == "." || last == ".."
+	if trailingSlash && p != "/" {
+		p += "/"
+	}
+	return p, nil
+}
+
+// decodePath はパーセントエンコーディングを解く。
+// デコード後に意味が変わってしまう文字がエンコードされていた場合はエラーにする。
+func decodePath(escaped string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(escaped); i++ {
+		c := escaped[i]
+		if c == '\\' || isControl(c) {
+			return "", ErrAmbiguousPath
+		}
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+
+		if i+2 >= len(escaped) || !isHex(escaped[i+1]) || !isHex(escaped[i+2]) {
+			return "", ErrAmbiguousPath
+		}
+		d := unhex(escaped[i+1])<<4 | unhex(escaped[i+2])
+		i += 2
+
+		switch {
+		case d == '/' || d == '\\' || isControl(d):
+			return "", ErrAmbiguousPath
+		case d == '%' && i+2 < len(escaped) && isHex(escaped[i+1]) && isHex(escaped[i+2]):
+			// 二重エンコード
+			return "", ErrAmbiguousPath
+		}
+		b.WriteByte(d)
+	}
+
+	// %C0%AE のような冗長なエンコードを . として解釈するバックエンドがある
+	if !utf8.ValidString(b.String()) {
+		return "", ErrAmbiguousPath
+	}
+	return b.String(), nil
+}
+
+func isControl(c byte) bool {
+	return c < 0x20 || c == 0x7f
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
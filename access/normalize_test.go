@@ -0,0 +1,97 @@
+package access
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCanonicalizePath(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  error
+	}{
+		{"", "/", nil},
+		{"/", "/", nil},
+		{"/a/b", "/a/b", nil},
+		{"//a///b/", "/a/b/", nil},
+		{"/a/./b", "/a/b", nil},
+		{"/a/b/../c", "/a/c", nil},
+		{"/a/b/..", "/a/", nil},
+		{"/a/b/.", "/a/b/", nil},
+		{"/a/%2e%2e/b", "/b", nil},
+		{"/a/%2E%2E/b", "/b", nil},
+		{"/a/.%2e/b", "/b", nil},
+		{"/a/%2e/b", "/a/b", nil},
+		{"/%e3%81%82", "/あ", nil},
+		{"/a%20b", "/a b", nil},
+		{"/a%25b", "/a%b", nil},
+		{"/ADMIN/x", "/ADMIN/x", nil},
+		{"/%41dmin/x", "/Admin/x", nil},
+
+		{"a/b", "", ErrAmbiguousPath},
+		{"/..", "", ErrAmbiguousPath},
+		{"/a/../..", "", ErrAmbiguousPath},
+		{"/%2e%2e/a", "", ErrAmbiguousPath},
+		{"/a/..;/b", "", ErrAmbiguousPath},
+		{"/a/.;x/b", "", ErrAmbiguousPath},
+		{"/a/%2e%2e;/b", "", ErrAmbiguousPath},
+		{"/admin;x/y", "", ErrAmbiguousPath},
+		{"/admin;/y", "", ErrAmbiguousPath},
+		{"/admin%3Bx/y", "", ErrAmbiguousPath},
+		{"/admin%3bx/y", "", ErrAmbiguousPath},
+		{"/admin/y;jsessionid=1", "", ErrAmbiguousPath},
+		{"/a%2fb", "", ErrAmbiguousPath},
+		{"/a%2Fb", "", ErrAmbiguousPath},
+		{"/a%5cb", "", ErrAmbiguousPath},
+		{"/a\\b", "", ErrAmbiguousPath},
+		{"/a%00b", "", ErrAmbiguousPath},
+		{"/a%0ab", "", ErrAmbiguousPath},
+		{"/a%7f", "", ErrAmbiguousPath},
+		{"/a%252e%252e/b", "", ErrAmbiguousPath},
+		{"/a%252fb", "", ErrAmbiguousPath},
+		{"/a%", "", ErrAmbiguousPath},
+		{"/a%2", "", ErrAmbiguousPath},
+		{"/a%zz", "", ErrAmbiguousPath},
+		{"/a/%C0%AE%C0%AE/b", "", ErrAmbiguousPath},
+		{"/a/%ff", "", ErrAmbiguousPath},
+		{"/%e3%81", "", ErrAmbiguousPath},
+	}
+
+	for _, tt := range tests {
+		got, err := canonicalizePath(tt.in)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("canonicalizePath(%q) error = %v, want %v", tt.in, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("canonicalizePath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// 正規化したパスは大文字と小文字を区別せずに照合するので、/admin の deny を /ADMIN で避けられない
+func TestCanonicalPathCaseInsensitive(t *testing.T) {
+	tests := []struct {
+		prefix, glob, regex string
+	}{
+		{prefix: "/admin"},
+		{glob: "/admin/*"},
+		{regex: "/admin/.*"},
+	}
+	for _, tt := range tests {
+		m, err := compilePathMatcher(tt.prefix, tt.glob, tt.regex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, in := range []string{"/admin/x", "/ADMIN/x", "/Admin/x", "/%41dmin/x", "/a/../AdMiN/x"} {
+			p, err := canonicalizePath(in)
+			if err != nil {
+				t.Fatalf("canonicalizePath(%q) error = %v", in, err)
+			}
+			if ok, _ := m.match(p); !ok {
+				t.Errorf("%+v does not match %q (%q)", tt, in, p)
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package access
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrMultiplePathPatterns = errors.New("only one of pathPrefix, pathGlob and pathRegex can be set")
+	ErrInvalidPathPattern   = errors.New("invalid path pattern")
+)
+
+// パスの指定方法は次の 3 つで、どれか 1 つだけを書ける。何も書かなければすべてのパスにマッチする。
+// どれかを書いたサイトには、テンプレートや defaults からほかの 2 つを引き継がない。
+//
+//   - pathPrefix: セグメント単位の前方一致。/hls は /hls と /hls/... にマッチし、/hlsfoo にはマッチしない
+//   - pathGlob: パス全体へのグロブ。* は / 以外の 0 文字以上、** は / を含む 0 文字以上、? は / 以外の 1 文字
+//   - pathRegex: パス全体にマッチする正規表現 (RE2)
+//
+// どの指定方法も大文字と小文字を区別しない。/admin の deny や /admin のサイトの roles を /ADMIN で避けられないように、
+// パスの大文字と小文字を区別しないバックエンドに合わせる。
+//
+// 同じホストの複数のサイトにマッチする場合は、パターン中の固定文字列が長いものを優先する。
+// 固定文字列の長さが同じなら pathRegex > pathGlob > pathPrefix の順で、それも同じなら先に書かれたものを優先する。
+
+type pathKind int
+
+const (
+	pathKindPrefix pathKind = iota
+	pathKindGlob
+	pathKindRegex
+)
+
+type pathMatcher struct {
+	kind   pathKind
+	prefix string
+	re     *regexp.Regexp
+	// パターンの先頭の固定文字列。pathRegex の場合は大文字と小文字を区別して求める
+	literalPrefix string
+	literal       int
+}
+
+func compilePathMatcher(pathPrefix, pathGlob, pathRegex string) (*pathMatcher, error) {
+	n := 0
+	for _, v := range []string{pathPrefix, pathGlob, pathRegex} {
+		if v != "" {
+			n += 1
+		}
+	}
+	if n > 1 {
+		return nil, ErrMultiplePathPatterns
+	}
+
+	switch {
+	case pathGlob != "":
+		if !strings.HasPrefix(pathGlob, "/") {
+			return nil, ErrInvalidPathPattern
+		}
+		re, err := regexp.Compile("(?i)" + globToRegexp(pathGlob))
+		if err != nil {
+			return nil, ErrInvalidPathPattern
+		}
+		literal := len(strings.NewReplacer("*", "", "?", "").Replace(pathGlob))
+		return &pathMatcher{kind: pathKindGlob, re: re, literal: literal}, nil
+	case pathRegex != "":
+		exact, err := regexp.Compile("^(?:" + pathRegex + ")$")
+		if err != nil {
+			return nil, ErrInvalidPathPattern
+		}
+		// (?i) を付けると英字が固定文字列に数えられなくなるので、優先順位は付けない場合の固定文字列で決める
+		literal, _ := exact.LiteralPrefix()
+		re := regexp.MustCompile("(?i)" + exact.String())
+		return &pathMatcher{kind: pathKindRegex, re: re, literalPrefix: literal, literal: len(literal)}, nil
+	default:
+		prefix := pathPrefix
+		if prefix == "" {
+			prefix = "/"
+		}
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, ErrInvalidPathPattern
+		}
+		return &pathMatcher{kind: pathKindPrefix, prefix: prefix, literalPrefix: prefix, literal: len(prefix)}, nil
+	}
+}
+
+// key は同じパスにマッチするパターンを見分けるための文字列を返す。pathPrefix を省略した場合と / は同じになる。
+func (m *pathMatcher) key() string {
+	if m.kind == pathKindPrefix {
+		return strconv.Itoa(int(m.kind)) + " " + strings.ToLower(m.prefix)
+	}
+	return strconv.Itoa(int(m.kind)) + " " + m.re.String()
+}
+
+// match はパスにマッチするかどうかと、マッチした場合の具体性を返す。
+func (m *pathMatcher) match(path string) (bool, int) {
+	if path == "" {
+		path = "/"
+	}
+
+	score := m.literal*3 + int(m.kind)
+
+	if m.kind != pathKindPrefix {
+		return m.re.MatchString(path), score
+	}
+
+	rest, ok := cutPrefixFold(path, m.prefix)
+	if !ok {
+		return false, 0
+	}
+	if strings.HasSuffix(m.prefix, "/") {
+		return true, score
+	}
+	return rest == "" || rest[0] == '/', score
+}
+
+// cutPrefixFold は大文字と小文字を区別せずに path から prefix を取り除く。
+func cutPrefixFold(path, prefix string) (string, bool) {
+	if len(path) < len(prefix) || !strings.EqualFold(path[:len(prefix)], prefix) {
+		return path, false
+	}
+	return path[len(prefix):], true
+}
+
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
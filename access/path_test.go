@@ -0,0 +1,117 @@
+package access
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestPathMatcher(t *testing.T) {
+	tests := []struct {
+		prefix, glob, regex string
+		path                string
+		want                bool
+	}{
+		{prefix: "", path: "/", want: true},
+		{prefix: "", path: "/anything/else", want: true},
+		{prefix: "/", path: "/hls", want: true},
+		{prefix: "/hls", path: "/hls", want: true},
+		{prefix: "/hls", path: "/hls/", want: true},
+		{prefix: "/hls", path: "/hls/a.m3u8", want: true},
+		{prefix: "/hls", path: "/hlsfoo", want: false},
+		{prefix: "/hls", path: "/hl", want: false},
+		{prefix: "/hls", path: "/", want: false},
+		{prefix: "/hls/", path: "/hls/a", want: true},
+		{prefix: "/hls/", path: "/hls", want: false},
+
+		{glob: "/hls/*.m3u8", path: "/hls/a.m3u8", want: true},
+		{glob: "/hls/*.m3u8", path: "/hls/a/b.m3u8", want: false},
+		{glob: "/hls/**.m3u8", path: "/hls/a/b.m3u8", want: true},
+		{glob: "/hls/?.ts", path: "/hls/1.ts", want: true},
+		{glob: "/hls/?.ts", path: "/hls/12.ts", want: false},
+		{glob: "/a.b", path: "/axb", want: false},
+
+		{regex: "/hls/[0-9]+", path: "/hls/123", want: true},
+		{regex: "/hls/[0-9]+", path: "/hls/123/x", want: false},
+		{regex: "/hls|/api", path: "/api", want: true},
+		{regex: "/hls|/api", path: "/apix", want: false},
+	}
+
+	for _, tt := range tests {
+		m, err := compilePathMatcher(tt.prefix, tt.glob, tt.regex)
+		if err != nil {
+			t.Fatalf("compilePathMatcher(%q, %q, %q) error = %v", tt.prefix, tt.glob, tt.regex, err)
+		}
+		if got, _ := m.match(tt.path); got != tt.want {
+			t.Errorf("%q%q%q match(%q) = %v, want %v", tt.prefix, tt.glob, tt.regex, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCompilePathMatcherError(t *testing.T) {
+	tests := []struct {
+		prefix, glob, regex string
+		want                error
+	}{
+		{prefix: "/a", glob: "/a/*", want: ErrMultiplePathPatterns},
+		{glob: "/a/*", regex: "/a/.*", want: ErrMultiplePathPatterns},
+		{prefix: "hls", want: ErrInvalidPathPattern},
+		{glob: "hls/*", want: ErrInvalidPathPattern},
+		{regex: "/(", want: ErrInvalidPathPattern},
+	}
+	for _, tt := range tests {
+		if _, err := compilePathMatcher(tt.prefix, tt.glob, tt.regex); !errors.Is(err, tt.want) {
+			t.Errorf("compilePathMatcher(%q, %q, %q) error = %v, want %v", tt.prefix, tt.glob, tt.regex, err, tt.want)
+		}
+	}
+}
+
+// 固定文字列が長いもの > pathRegex > pathGlob > pathPrefix > 先に書かれたもの の順に優先する
+func TestPathPrecedence(t *testing.T) {
+	l := mustParse(t, `
+sites:
+  - {id: root, host: example.com, auth: public, backend: "http://b"}
+  - {id: hls, host: example.com, pathPrefix: /hls, auth: public, backend: "http://b"}
+  - {id: hls-live, host: example.com, pathPrefix: /hls/live, auth: public, backend: "http://b"}
+  - {id: glob-ts, host: example.com, pathGlob: "/hls/*.ts", auth: public, backend: "http://b"}
+  - {id: regex-ts, host: example.com, pathRegex: "/hls/[a-z]+\\.ts", auth: public, backend: "http://b"}
+  - {id: api-prefix, host: example.com, pathPrefix: /api, auth: public, backend: "http://b"}
+  - {id: api-glob, host: example.com, pathGlob: "/api*", auth: public, backend: "http://b"}
+  - {id: api-regex, host: example.com, pathRegex: "/api.*", auth: public, backend: "http://b"}
+  - {id: first, host: example.com, pathGlob: "/x/*", auth: public, backend: "http://b"}
+  - {id: second, host: example.com, pathGlob: "/x/?*", auth: public, backend: "http://b"}
+`)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", "root"},
+		{"/hlsfoo", "root"},
+		{"/hls", "hls"},
+		{"/hls/a.m3u8", "hls"},
+		{"/hls/live", "hls-live"},
+		{"/hls/live/a.ts", "hls-live"},
+		// pathRegex の固定文字列は先頭の /hls/ だけなので、/hls/ と .ts を数える pathGlob を優先する
+		{"/hls/abc.ts", "glob-ts"},
+		{"/hls/abc.tsx", "hls"},
+		// /hls/live はセグメント単位なので /hls/live.ts にはマッチしない
+		{"/hls/live.ts", "glob-ts"},
+		// 固定文字列が同じ /api なので、pathRegex > pathGlob > pathPrefix
+		{"/api", "api-regex"},
+		{"/api/v1", "api-regex"},
+		// 固定文字列の長さも種類も同じなので、先に書かれたもの
+		{"/x/a", "first"},
+		{"/HLS/LIVE/a.ts", "hls-live"},
+	}
+	for _, tt := range tests {
+		site, err := findMatchSite(url.URL{Host: "example.com", Path: tt.path}, *l)
+		if err != nil {
+			t.Errorf("findMatchSite(%q) error = %v", tt.path, err)
+			continue
+		}
+		if site.ID != tt.want {
+			t.Errorf("findMatchSite(%q) = %s, want %s", tt.path, site.ID, tt.want)
+		}
+	}
+}
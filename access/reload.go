@@ -0,0 +1,34 @@
+package access
+
+import (
+	"log"
+	"time"
+)
+
+// Watch は interval ごとに path を読み、内容が変わっていれば設定を読み込み直す。
+// ConfigMap のようにシンボリックリンクごと差し替えられる場合もあるので、mtime ではなく内容のハッシュで比較する。
+func Watch(path string, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			files, err := readListFiles(path)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if hashFiles(files) == CalculateListHash() {
+				continue
+			}
+
+			Reload(path)
+		}
+	}()
+}
+
+// Reload は設定を読み込み直す。失敗した場合は古い設定を使い続ける。
+func Reload(path string) {
+	if err := Load(path); err != nil {
+		log.Println("設定の再読み込みに失敗したので、古い設定を使い続ける", err)
+		return
+	}
+	log.Println("設定を再読み込みした", CalculateListHash())
+}
@@ -0,0 +1,94 @@
+package access
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// バックエンドに送るパスは stripPrefix、rewrites、addPrefix の順に書き換える。
+// レスポンスの Location と Set-Cookie の Path は、stripPrefix と addPrefix だけを逆にたどって公開側のパスに戻す。
+// rewrites は逆変換できないので戻さない。
+
+var ErrInvalidRewrite = errors.New("invalid path rewrite")
+
+type PathRewrite struct {
+	// Regex にマッチしたパスを Replace に置き換える。Replace では $1 や ${name} でグループを参照できる。
+	Regex   string `yaml:"regex"`
+	Replace string `yaml:"replace"`
+
+	re *regexp.Regexp
+}
+
+func compileRewrite(site *Site) error {
+	for _, p := range []*string{&site.StripPrefix, &site.AddPrefix} {
+		if *p == "" {
+			continue
+		}
+		if !strings.HasPrefix(*p, "/") {
+			return fmt.Errorf("%w: prefix must start with /: %s", ErrInvalidRewrite, *p)
+		}
+		*p = strings.TrimRight(*p, "/")
+	}
+	for i := range site.Rewrites {
+		r := &site.Rewrites[i]
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidRewrite, err)
+		}
+		r.re = re
+	}
+	return nil
+}
+
+// trimPathPrefix は prefix をセグメント単位で取り除く。サイトのパスと同じく大文字と小文字は区別しない。
+// prefix で始まらない場合は false を返す。
+func trimPathPrefix(path, prefix string) (string, bool) {
+	if prefix == "" {
+		return path, true
+	}
+	rest, ok := cutPrefixFold(path, prefix)
+	if !ok {
+		return path, false
+	}
+	if rest == "" {
+		return "/", true
+	}
+	if rest[0] != '/' {
+		return path, false
+	}
+	return rest, true
+}
+
+// BackendPath は公開側のパスを、バックエンドに送るパスに書き換える。
+func (site *Site) BackendPath(path string) string {
+	path, _ = trimPathPrefix(path, site.StripPrefix)
+	for _, r := range site.Rewrites {
+		if r.re.MatchString(path) {
+			path = r.re.ReplaceAllString(path, r.Replace)
+			break
+		}
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if site.AddPrefix != "" {
+		path = site.AddPrefix + path
+	}
+	return path
+}
+
+// PublicPath はバックエンドが返したパスを公開側のパスに戻す。addPrefix の外を指すパスはそのまま返す。
+func (site *Site) PublicPath(path string) string {
+	rest, ok := trimPathPrefix(path, site.AddPrefix)
+	if !ok {
+		return path
+	}
+	return site.StripPrefix + rest
+}
+
+// RewritesPath はパスの書き換えを設定しているかどうかを返す。
+func (site *Site) RewritesPath() bool {
+	return site.StripPrefix != "" || site.AddPrefix != "" || len(site.Rewrites) > 0
+}
@@ -0,0 +1,129 @@
+package access
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata"
+
+	"golang.org/x/exp/slices"
+)
+
+// notBefore / notAfter と schedules で、サイトを公開する期間を決められる。
+// どちらも書かなければいつでも公開する。schedules を書いた場合は、いずれかのスケジュールの時間帯だけ公開する。
+
+var (
+	ErrInvalidSchedule   = errors.New("invalid schedule")
+	ErrInvalidTimeWindow = errors.New("notBefore must be before notAfter")
+)
+
+// Schedule は毎週繰り返す公開時間帯。
+// End が Start 以前なら日をまたぐ時間帯とみなし、Weekdays は Start 側の曜日で判定する。
+type Schedule struct {
+	// sun, mon, tue, wed, thu, fri, sat。省略した場合は毎日
+	Weekdays []string `yaml:"weekdays"`
+	// HH:MM
+	Start string `yaml:"start"`
+	// HH:MM
+	End string `yaml:"end"`
+	// IANA のタイムゾーン名。省略した場合は Asia/Tokyo
+	TimeZone string `yaml:"timeZone"`
+
+	weekdays []time.Weekday
+	start    int
+	end      int
+	loc      *time.Location
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func compileSchedule(s *Schedule) error {
+	for _, w := range s.Weekdays {
+		i := slices.Index(weekdayNames, strings.ToLower(w))
+		if i < 0 {
+			return fmt.Errorf("%w: unknown weekday %s", ErrInvalidSchedule, w)
+		}
+		s.weekdays = append(s.weekdays, time.Weekday(i))
+	}
+
+	var err error
+	if s.start, err = parseClock(s.Start); err != nil {
+		return err
+	}
+	if s.end, err = parseClock(s.End); err != nil {
+		return err
+	}
+
+	tz := s.TimeZone
+	if tz == "" {
+		tz = "Asia/Tokyo"
+	}
+	if s.loc, err = time.LoadLocation(tz); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSchedule, err)
+	}
+	return nil
+}
+
+// parseClock は HH:MM を 0 時からの分に変換する。
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid time %q", ErrInvalidSchedule, v)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (s *Schedule) contains(now time.Time) bool {
+	t := now.In(s.loc)
+	minute := t.Hour()*60 + t.Minute()
+
+	onDay := func(w time.Weekday) bool {
+		return len(s.weekdays) == 0 || slices.Contains(s.weekdays, w)
+	}
+
+	if s.start < s.end {
+		return onDay(t.Weekday()) && s.start <= minute && minute < s.end
+	}
+
+	// 日をまたぐ
+	if minute >= s.start {
+		return onDay(t.Weekday())
+	}
+	if minute < s.end {
+		return onDay((t.Weekday() + 6) % 7)
+	}
+	return false
+}
+
+func compileTimeWindow(site *Site) error {
+	if site.NotBefore != nil && site.NotAfter != nil && !site.NotBefore.Before(*site.NotAfter) {
+		return ErrInvalidTimeWindow
+	}
+	for i := range site.Schedules {
+		if err := compileSchedule(&site.Schedules[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckTime は now にサイトが公開されているかどうかを返す。
+func (site *Site) CheckTime(now time.Time) Decision {
+	if site.NotBefore != nil && now.Before(*site.NotBefore) {
+		return NotYetOpen
+	}
+	if site.NotAfter != nil && !now.Before(*site.NotAfter) {
+		return AlreadyClosed
+	}
+
+	if len(site.Schedules) == 0 {
+		return Allowed
+	}
+	for i := range site.Schedules {
+		if site.Schedules[i].contains(now) {
+			return Allowed
+		}
+	}
+	return OutsideSchedule
+}
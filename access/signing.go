@@ -0,0 +1,59 @@
+package access
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// signing を書いたサイトには、secretFile の鍵で HMAC 署名したリクエストを送る。署名の形式は signature パッケージを参照。
+// 鍵は設定を読み込むときに読む。設定ファイルの変更と違って鍵の変更は検知しないので、入れ替えたら SIGHUP を送る。
+
+var ErrInvalidSigning = errors.New("invalid signing")
+
+type Signing struct {
+	SecretFile string `yaml:"secretFile"`
+
+	key []byte
+}
+
+func compileSigning(site *Site) error {
+	s := site.Signing
+	if s == nil {
+		return nil
+	}
+	if s.SecretFile == "" {
+		return fmt.Errorf("%w: secretFile is required", ErrInvalidSigning)
+	}
+	b, err := os.ReadFile(s.SecretFile)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSigning, err)
+	}
+	// ファイルの末尾の改行は鍵に含めない
+	s.key = bytes.TrimRight(b, "\r\n")
+	if len(s.key) == 0 {
+		return fmt.Errorf("%w: %s is empty", ErrInvalidSigning, s.SecretFile)
+	}
+	return nil
+}
+
+// SigningKey は署名に使う鍵を返す。署名しないサイトでは nil を返す。
+func (site *Site) SigningKey() []byte {
+	if site.Signing == nil {
+		return nil
+	}
+	return site.Signing.key
+}
+
+// SignedHeaderNames は署名に含める、ユーザーの情報のヘッダーの名前を返す。
+func (site *Site) SignedHeaderNames() []string {
+	var names []string
+	if h := site.IdentityHeaders; h != nil {
+		names = append(names, h.User, h.Email, h.Roles)
+	}
+	if a := site.Assertion; a != nil {
+		names = append(names, a.Header)
+	}
+	return names
+}
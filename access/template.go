@@ -0,0 +1,196 @@
+package access
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 設定の重複を減らすために、次のものが使える。
+//
+//   - roleGroups: ロールのグループ。roles や exceptRoles に @name と書くとメンバーに展開する。グループは入れ子にできる
+//   - defaults: すべてのサイトに共通の値
+//   - templates: サイトが extends で指定して引き継ぐ値。テンプレートも extends で別のテンプレートを引き継げる
+//
+// サイトに書いた値 > extends したテンプレート (近いものから順に) > defaults の順に優先する。
+// 複数のファイルに分けた場合も、roleGroups と templates はすべてのファイルで共有する。同じ名前を複数のファイルで定義したり、defaults を複数のファイルに書いたりするとエラーになる。
+
+var (
+	ErrUndefinedTemplate  = errors.New("undefined template")
+	ErrUndefinedRoleGroup = errors.New("undefined role group")
+	ErrCyclicReference    = errors.New("cyclic reference")
+)
+
+// yamlFields は yaml タグのキー名ごとの Site のフィールドの位置
+var yamlFields = func() map[string]int {
+	m := make(map[string]int)
+	t := reflect.TypeOf(Site{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		m[name] = i
+	}
+	return m
+}()
+
+// mappingKeys はマッピングに書かれたキーを返す。
+func mappingKeys(node *yaml.Node) map[string]bool {
+	keys := make(map[string]bool)
+	if node == nil || node.Kind != yaml.MappingNode {
+		return keys
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keys[node.Content[i].Value] = true
+	}
+	return keys
+}
+
+// exclusiveFields は同時に書けないキーの組。どれかを書いたサイトには、同じ組のほかのキーを引き継がない。
+var exclusiveFields = func() map[string][]string {
+	m := make(map[string][]string)
+	for _, group := range [][]string{
+		{"backend", "backends"},
+		{"pathPrefix", "pathGlob", "pathRegex"},
+	} {
+		for _, key := range group {
+			m[key] = group
+		}
+	}
+	return m
+}()
+
+// hasExclusiveField は key と同時に書けないキーを site に書いたかどうかを返す。
+func hasExclusiveField(site *Site, key string) bool {
+	for _, other := range exclusiveFields[key] {
+		if other != key && site.setFields[other] {
+			return true
+		}
+	}
+	return false
+}
+
+// inherit は dst に書かれていないキーの値を src からコピーする。
+func inherit(dst *Site, src *Site) {
+	dv := reflect.ValueOf(dst).Elem()
+	sv := reflect.ValueOf(src).Elem()
+	for key := range src.setFields {
+		if key == "id" || key == "extends" || dst.setFields[key] || hasExclusiveField(dst, key) {
+			continue
+		}
+		i, ok := yamlFields[key]
+		if !ok {
+			continue
+		}
+		dv.Field(i).Set(sv.Field(i))
+		dst.setFields[key] = true
+	}
+}
+
+// expandSite は extends と defaults を site に反映し、ロールのグループを展開する。
+func expandSite(site *Site, l *SettingList) error {
+	if site.setFields == nil {
+		site.setFields = make(map[string]bool)
+	}
+
+	visited := make(map[string]bool)
+	for name := site.Extends; name != ""; {
+		if visited[name] {
+			return fmt.Errorf("%w: extends %s", ErrCyclicReference, name)
+		}
+		visited[name] = true
+
+		t, ok := l.Templates[name]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUndefinedTemplate, name)
+		}
+		inherit(site, &t)
+		name = t.Extends
+	}
+
+	if l.Defaults != nil {
+		inherit(site, l.Defaults)
+	}
+
+	var err error
+	if site.Roles, err = expandRoles(site.Roles, l.RoleGroups); err != nil {
+		return err
+	}
+	// テンプレートと共有しているので、書き換える前にコピーする
+	methodRoles := make([]MethodRole, len(site.MethodRoles))
+	for i, mr := range site.MethodRoles {
+		methodRoles[i] = MethodRole{Methods: append([]string(nil), mr.Methods...)}
+		if methodRoles[i].Roles, err = expandRoles(mr.Roles, l.RoleGroups); err != nil {
+			return err
+		}
+	}
+	site.MethodRoles = methodRoles
+	site.Methods = append([]string(nil), site.Methods...)
+	site.Schedules = append([]Schedule(nil), site.Schedules...)
+	site.Rewrites = append([]PathRewrite(nil), site.Rewrites...)
+	site.Backends = append([]string(nil), site.Backends...)
+	if site.HealthCheck != nil {
+		hc := *site.HealthCheck
+		site.HealthCheck = &hc
+	}
+	if site.Transport != nil {
+		t := *site.Transport
+		site.Transport = &t
+	}
+	if site.IdentityHeaders != nil {
+		h := *site.IdentityHeaders
+		site.IdentityHeaders = &h
+	}
+	if site.Assertion != nil {
+		a := *site.Assertion
+		site.Assertion = &a
+	}
+	if site.Signing != nil {
+		sg := *site.Signing
+		site.Signing = &sg
+	}
+	return nil
+}
+
+// expandRoles は @name をグループのメンバーに展開する。
+func expandRoles(roles []string, groups map[string][]string) ([]string, error) {
+	var r []string
+	seen := make(map[string]bool)
+
+	var expand func(roles []string, visiting map[string]bool) error
+	expand = func(roles []string, visiting map[string]bool) error {
+		for _, role := range roles {
+			name, ok := strings.CutPrefix(role, "@")
+			if !ok {
+				if !seen[role] {
+					seen[role] = true
+					r = append(r, role)
+				}
+				continue
+			}
+
+			if visiting[name] {
+				return fmt.Errorf("%w: roleGroups %s", ErrCyclicReference, name)
+			}
+			members, ok := groups[name]
+			if !ok {
+				return fmt.Errorf("%w: %s", ErrUndefinedRoleGroup, name)
+			}
+			visiting[name] = true
+			if err := expand(members, visiting); err != nil {
+				return err
+			}
+			delete(visiting, name)
+		}
+		return nil
+	}
+
+	if err := expand(roles, make(map[string]bool)); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,185 @@
+package access
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem は設定の検証で見つかった問題
+type Problem struct {
+	File string
+	// 問題のある箇所の行番号。特定できない場合は 0
+	Line    int
+	Warning bool
+	Message string
+}
+
+// ValidatePath はサーバーと同じ方法で path から設定を読み込み、エラーと警告をすべて返す。
+// エラーがある設定は Load できない。警告は読み込めるが意図どおりに動かないかもしれないもの。
+func ValidatePath(path string) []Problem {
+	files, err := readListFiles(path)
+	if err != nil {
+		return []Problem{{File: path, Message: err.Error()}}
+	}
+
+	var problems []Problem
+
+	l, errs := decodeFiles(files)
+	for _, err := range errs {
+		problems = append(problems, decodeProblems(err)...)
+	}
+
+	compiled := make(map[int]bool)
+	for i := range l.Sites {
+		compiled[i] = true
+	}
+	for _, e := range compileList(l) {
+		problems = append(problems, Problem{File: e.pos.file, Line: e.pos.line, Message: e.detail()})
+		if e.section == "sites" {
+			compiled[e.index] = false
+		}
+	}
+
+	var ok []int
+	for i := range l.Sites {
+		if compiled[i] {
+			ok = append(ok, i)
+		}
+	}
+	problems = append(problems, checkSites(l, ok)...)
+
+	// Load と同じく OnLoad で登録した確認も行う。読み込めない設定は渡さない
+	if len(errs) == 0 && len(ok) == len(l.Sites) && !hasError(problems) {
+		for _, f := range loadHooks {
+			if err := f(l); err != nil {
+				problems = append(problems, Problem{File: path, Message: err.Error()})
+				break
+			}
+		}
+	}
+
+	return problems
+}
+
+func hasError(problems []Problem) bool {
+	for _, p := range problems {
+		if !p.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeProblems はデコードのエラーを、行ごとの Problem に分ける。
+func decodeProblems(err error) []Problem {
+	var fe *fileError
+	if !errors.As(err, &fe) {
+		return []Problem{{Message: err.Error()}}
+	}
+
+	lineOf := yamlErrorLine
+	if strings.ToLower(filepath.Ext(fe.file)) == ".toml" {
+		// TOML は YAML に変換してから読むので、YAML の行番号は使えない
+		lineOf = func(string) int { return 0 }
+	}
+
+	var typeErr *yaml.TypeError
+	if errors.As(fe.err, &typeErr) {
+		var problems []Problem
+		for _, e := range typeErr.Errors {
+			problems = append(problems, Problem{File: fe.file, Line: lineOf(e), Message: e})
+		}
+		return problems
+	}
+	return []Problem{{File: fe.file, Line: lineOf(fe.err.Error()), Message: fe.err.Error()}}
+}
+
+// checkSites は読み込めたサイトについて、意味的な問題を探す。
+func checkSites(l *SettingList, indexes []int) []Problem {
+	var problems []Problem
+	add := func(i int, warning bool, format string, args ...any) {
+		problems = append(problems, Problem{
+			File:    l.Sites[i].pos.file,
+			Line:    l.Sites[i].pos.line,
+			Warning: warning,
+			Message: fmt.Sprintf("sites: %s: ", l.Sites[i].ID) + fmt.Sprintf(format, args...),
+		})
+	}
+
+	var sub SettingList
+	for _, i := range indexes {
+		sub.Sites = append(sub.Sites, l.Sites[i])
+	}
+
+	for n, i := range indexes {
+		site := l.Sites[i]
+
+		if host, path, ok := samplePath(site); ok {
+			if found, err := findMatchSiteIndex(url.URL{Host: host, Path: path}, sub); err == nil && found != n {
+				add(i, true, "%s%s は %s にマッチするので、このサイトは使われない可能性がある", host, path, sub.Sites[found].describe())
+			}
+		}
+
+		hasMethodRoles := false
+		for _, mr := range site.MethodRoles {
+			if len(mr.Roles) > 0 {
+				hasMethodRoles = true
+			}
+			for _, m := range mr.Methods {
+				if !site.AllowsMethod(m) {
+					add(i, true, "methodRoles の %s は methods に含まれていないので使われない", m)
+				}
+			}
+		}
+
+		if site.Auth != AuthPublic && len(site.Roles) == 0 && !hasMethodRoles && site.Require == "" {
+			add(i, true, "roles も require もないので、ログインしても誰もアクセスできない")
+		}
+
+		if site.NotAfter != nil && site.NotAfter.Before(time.Now()) {
+			add(i, true, "notAfter (%s) を過ぎているので、もうアクセスできない", site.NotAfter.Format(time.RFC3339))
+		}
+	}
+
+	return problems
+}
+
+// samplePath はサイトに確実にマッチするはずのホストとパスを作る。作れない場合は false を返す。
+func samplePath(site Site) (string, string, bool) {
+	host := site.Host
+	if strings.HasPrefix(host, "*.") {
+		host = "x" + host[1:]
+	}
+
+	var path string
+	switch site.path.kind {
+	case pathKindPrefix:
+		path = site.path.prefix
+	case pathKindGlob:
+		path = strings.NewReplacer("**", "x", "*", "x", "?", "x").Replace(site.PathGlob)
+	case pathKindRegex:
+		path = site.path.literalPrefix
+	}
+
+	ok, _ := site.path.match(path)
+	return host, path, ok
+}
+
+var yamlLinePattern = regexp.MustCompile(`line (\d+):`)
+
+func yamlErrorLine(msg string) int {
+	m := yamlLinePattern.FindStringSubmatch(msg)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
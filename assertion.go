@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/comame/id-proxy/access"
+	"github.com/comame/id-proxy/jwt"
+)
+
+// signingKeys は assertion の署名に使う鍵。先頭の鍵で署名し、残りは鍵を入れ替える間も検証できるように公開だけする。
+var signingKeys []*jwt.SigningKey
+
+// ErrNoSigningKey は assertion を書いたサイトがあるのに、署名する鍵がないことを表す
+var ErrNoSigningKey = errors.New("assertion requires ASSERTION_KEY_PATH")
+
+const defaultAssertionIssuer = "id-proxy"
+
+// initSigningKeys は ASSERTION_KEY_PATH から鍵を読む。
+// 指定がない場合は鍵を持たず、assertion を書いたサイトがあれば設定の読み込みを失敗させる。
+// プロセスごとに鍵を作ると、複数のプロセスで動かしたときや再起動したときにバックエンドが検証できなくなるため。
+func initSigningKeys() error {
+	if env.AssertionIssuer == "" {
+		env.AssertionIssuer = defaultAssertionIssuer
+	}
+	if env.AssertionKeyPath == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(env.AssertionKeyPath)
+	if err != nil {
+		return err
+	}
+	keys, err := jwt.ParseSigningKeys(b)
+	if err != nil {
+		return err
+	}
+	signingKeys = keys
+	return nil
+}
+
+// checkSigningKeys は assertion を書いたサイトがある場合に、署名する鍵があるかどうかを確かめる。
+func checkSigningKeys(l *access.SettingList) error {
+	if len(signingKeys) > 0 {
+		return nil
+	}
+	for i := range l.Sites {
+		if l.Sites[i].Assertion != nil {
+			return fmt.Errorf("%w: site %s", ErrNoSigningKey, l.Sites[i].ID)
+		}
+	}
+	return nil
+}
+
+type assertionClaims struct {
+	Iss   string   `json:"iss"`
+	Sub   string   `json:"sub"`
+	Aud   string   `json:"aud"`
+	Iat   int64    `json:"iat"`
+	Exp   int64    `json:"exp"`
+	Roles []string `json:"roles"`
+	Email string   `json:"email,omitempty"`
+}
+
+type cachedAssertion struct {
+	token string
+	exp   time.Time
+}
+
+var (
+	assertionCacheMu sync.Mutex
+	// perSession のサイトで使い回す JWT
+	assertionCache = map[string]cachedAssertion{}
+)
+
+// setAssertion はサイトが求める場合に、s の情報を署名した JWT をヘッダーに入れる。
+func setAssertion(h http.Header, site *access.Site, s *Session) {
+	a := site.Assertion
+	if a == nil || s == nil {
+		return
+	}
+
+	token, err := assertionFor(site, s)
+	if err != nil {
+		log.Println("assertion の署名に失敗した", err)
+		return
+	}
+	h.Set(a.Header, token)
+}
+
+func assertionFor(site *access.Site, s *Session) (string, error) {
+	now := time.Now()
+	a := site.Assertion
+
+	key := strings.Join([]string{site.ID, s.Sub, s.Sid, strings.Join(s.Roles, ",")}, "\x00")
+	if a.PerSession {
+		assertionCacheMu.Lock()
+		c, ok := assertionCache[key]
+		assertionCacheMu.Unlock()
+		// 有効期間の残りが短いものは、バックエンドに届くまでに切れないように作り直す
+		if ok && now.Add(a.TTL/4).Before(c.exp) {
+			return c.token, nil
+		}
+	}
+
+	exp := now.Add(a.TTL)
+	claims := assertionClaims{
+		// クライアントが送ってきた Host ヘッダーで iss が変わらないように、設定した値を使う
+		Iss:   env.AssertionIssuer,
+		Sub:   s.Sub,
+		Aud:   site.ID,
+		Iat:   now.Unix(),
+		Exp:   exp.Unix(),
+		Roles: s.Roles,
+	}
+	if email, ok := s.Claims["email"].(string); ok {
+		claims.Email = email
+	}
+	token, err := jwt.Sign(claims, signingKeys[0])
+	if err != nil {
+		return "", err
+	}
+
+	if a.PerSession {
+		assertionCacheMu.Lock()
+		for k, c := range assertionCache {
+			if !now.Before(c.exp) {
+				delete(assertionCache, k)
+			}
+		}
+		assertionCache[key] = cachedAssertion{token: token, exp: exp}
+		assertionCacheMu.Unlock()
+	}
+	return token, nil
+}
+
+// handleJWKS は assertion を検証するための公開鍵を返す。
+func handleJWKS(w http.ResponseWriter, r *http.Request) {
+	var jwk jwt.JWK
+	for _, k := range signingKeys {
+		jwk.Keys = append(jwk.Keys, k.PublicJWK())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(jwk)
+}
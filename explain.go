@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/comame/id-proxy/access"
+)
+
+type explainParams struct {
+	URL       string
+	Method    string
+	Roles     string
+	Claims    string
+	IP        string
+	Time      string
+	Anonymous bool
+}
+
+// build は params から判定に使うリクエストとユーザーを作る。未ログインの場合、ユーザーは nil になる。
+func (p explainParams) build() (access.Request, *access.Identity, error) {
+	u, err := url.Parse(p.URL)
+	if err != nil || u.Host == "" {
+		return access.Request{}, nil, errors.New("url must be absolute")
+	}
+	if err := access.CanonicalizeURL(u); err != nil {
+		return access.Request{}, nil, err
+	}
+
+	req := access.Request{
+		URL:    *u,
+		Method: strings.ToUpper(p.Method),
+	}
+	if req.Method == "" {
+		req.Method = http.MethodGet
+	}
+	if p.IP != "" {
+		if req.ClientIP, err = netip.ParseAddr(p.IP); err != nil {
+			return access.Request{}, nil, err
+		}
+	}
+	if p.Time != "" {
+		if req.Time, err = time.Parse(time.RFC3339, p.Time); err != nil {
+			return access.Request{}, nil, err
+		}
+	}
+
+	if p.Anonymous {
+		return req, nil, nil
+	}
+
+	var id access.Identity
+	if p.Claims != "" {
+		if err := json.Unmarshal([]byte(p.Claims), &id.Claims); err != nil {
+			return access.Request{}, nil, fmt.Errorf("invalid claims: %w", err)
+		}
+	}
+	if p.Roles != "" {
+		id.Roles = strings.Split(p.Roles, ",")
+	} else if roles, ok := id.Claims["roles"].([]any); ok {
+		for _, r := range roles {
+			if s, ok := r.(string); ok {
+				id.Roles = append(id.Roles, s)
+			}
+		}
+	}
+	return req, &id, nil
+}
+
+// runExplain は URL へのアクセスがどう判定されるかを表示する。
+func runExplain(args []string) int {
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	listPath := fs.String("list", listPathFromArgs(nil), "設定ファイルのパス")
+	asJSON := fs.Bool("json", false, "JSON で出力する")
+
+	var p explainParams
+	fs.StringVar(&p.Method, "method", http.MethodGet, "リクエストのメソッド")
+	fs.StringVar(&p.Roles, "roles", "", "ユーザーのロール (カンマ区切り)")
+	fs.StringVar(&p.Claims, "claims", "", "ID Token のクレーム (JSON)")
+	fs.StringVar(&p.IP, "ip", "", "クライアントの IP アドレス")
+	fs.StringVar(&p.Time, "time", "", "判定する時刻 (RFC3339)。省略した場合は現在時刻")
+	fs.BoolVar(&p.Anonymous, "anonymous", false, "未ログインのリクエストとして判定する")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: id-proxy explain [options] URL")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	p.URL = fs.Arg(0)
+
+	if err := access.Load(*listPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	req, id, err := p.build()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	e := access.Explain(req, id)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(e)
+	} else {
+		fmt.Print(e.String())
+	}
+
+	if e.Decision != access.Allowed {
+		return 1
+	}
+	return 0
+}
+
+// handleExplain は管理者向けに、runExplain と同じ判定を JSON で返す。
+func handleExplain(w http.ResponseWriter, r *http.Request) {
+	if env.AdminRoles == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	c, err := r.Cookie("__idproxy")
+	if err != nil {
+		startSessionAndRedirect(w, r)
+		return
+	}
+	s, ok := GetSession(CalculateSession(c.Value))
+	if !ok {
+		startSessionAndRedirect(w, r)
+		return
+	}
+	if !isAdmin(s) {
+		log.Println("管理者ではない", s.Sub)
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "アクセス権限がありません")
+		return
+	}
+
+	q := r.URL.Query()
+	p := explainParams{
+		URL:       q.Get("url"),
+		Method:    q.Get("method"),
+		Roles:     q.Get("roles"),
+		Claims:    q.Get("claims"),
+		IP:        q.Get("ip"),
+		Time:      q.Get("time"),
+		Anonymous: q.Get("anonymous") == "true",
+	}
+	req, id, err := p.build()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(access.Explain(req, id))
+}
+
+func isAdmin(s *Session) bool {
+	for _, role := range strings.Split(env.AdminRoles, ",") {
+		for _, r := range s.Roles {
+			if r == role {
+				return true
+			}
+		}
+	}
+	return false
+}
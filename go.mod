@@ -3,6 +3,7 @@ go 1.20
 module github.com/comame/id-proxy
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/comame/readenv-go v1.1.0
 	github.com/comame/router-go v1.3.0
 	github.com/redis/go-redis/v9 v9.0.5
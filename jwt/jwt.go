@@ -14,6 +14,7 @@ import (
 type Header struct {
 	Typ string `json:"typ"`
 	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
 }
 
 type Payload struct {
@@ -23,9 +24,13 @@ type Payload struct {
 	Exp   uint64 `json:"exp"`
 	Iat   uint64 `json:"iat"`
 	Nonce string `json:"nonce"`
+	Sid   string `json:"sid"`
 
 	// Custom claim
 	Roles []string `json:"roles"`
+
+	// すべてのクレーム
+	Claims map[string]any `json:"-"`
 }
 
 type JWT struct {
@@ -67,6 +72,10 @@ func Decode(idToken string) (*JWT, error) {
 		log.Println(err)
 		return nil, ErrInvalidJWTFormat
 	}
+	if err := json.Unmarshal(pb, &payload.Claims); err != nil {
+		log.Println(err)
+		return nil, ErrInvalidJWTFormat
+	}
 
 	return &JWT{
 		Header:  header,
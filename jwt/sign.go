@@ -0,0 +1,109 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+)
+
+var (
+	ErrNoPrivateKey          = errors.New("no private key in PEM")
+	ErrUnsupportedPrivateKey = errors.New("unsupported private key")
+)
+
+// SigningKey は RS256 で署名するための鍵
+type SigningKey struct {
+	Kid     string
+	Private *rsa.PrivateKey
+}
+
+// NewSigningKey は公開鍵から kid を決めて SigningKey を作る。
+func NewSigningKey(priv *rsa.PrivateKey) *SigningKey {
+	// 同じ鍵ならどのプロセスでも同じ kid になるように、公開鍵のハッシュを使う
+	h := sha256.Sum256(priv.PublicKey.N.Bytes())
+	return &SigningKey{
+		Kid:     base64.RawURLEncoding.EncodeToString(h[:16]),
+		Private: priv,
+	}
+}
+
+// ParseSigningKeys は PEM に含まれる RSA の秘密鍵をすべて読む。PKCS #1 と PKCS #8 に対応する。
+func ParseSigningKeys(b []byte) ([]*SigningKey, error) {
+	var keys []*SigningKey
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+
+		var priv *rsa.PrivateKey
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			k, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			priv = k
+		case "PRIVATE KEY":
+			k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			rk, ok := k.(*rsa.PrivateKey)
+			if !ok {
+				return nil, ErrUnsupportedPrivateKey
+			}
+			priv = rk
+		default:
+			continue
+		}
+		keys = append(keys, NewSigningKey(priv))
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrNoPrivateKey
+	}
+	return keys, nil
+}
+
+// PublicJWK は公開鍵を JWK の形式で返す。
+func (k *SigningKey) PublicJWK() JwkKey {
+	pub := k.Private.PublicKey
+	return JwkKey{
+		N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		Kty: "RSA",
+		Alg: "RS256",
+		Kid: k.Kid,
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		Use: "sig",
+	}
+}
+
+// Sign は claims を JSON にして RS256 で署名した JWT を返す。
+func Sign(claims any, key *SigningKey) (string, error) {
+	hb, err := json.Marshal(Header{Typ: "JWT", Alg: "RS256", Kid: key.Kid})
+	if err != nil {
+		return "", err
+	}
+	pb, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	msg := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(pb)
+	digest := sha256.Sum256([]byte(msg))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key.Private, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return msg + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
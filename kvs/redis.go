@@ -36,6 +36,16 @@ func Set(key, value string, expireSec uint) error {
 	return nil
 }
 
+// Update は有効期限を変えずに値だけを書き換える
+func Update(key, value string) error {
+	err := con().Set(context.Background(), k(key), value, redis.KeepTTL).Err()
+
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 func Get(key string) (string, error) {
 	v, err := con().Get(context.Background(), k(key)).Result()
 	if err != nil {
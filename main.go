@@ -1,12 +1,17 @@
 package main
 
 import (
-	_ "embed"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/comame/id-proxy/access"
 	"github.com/comame/id-proxy/kvs"
@@ -22,36 +27,77 @@ type envType struct {
 	OIDCIssuer       string `env:"OIDC_ISSUER"`
 	OIDCClientID     string `env:"OIDC_CLIENT_ID"`
 	OIDCClientSecret string `env:"OIDC_CLIENT_SECRET"`
+
+	ListPath string `env:"LIST_PATH,optional"`
+
+	// カンマ区切り。書いた場合、このロールを持つユーザーは /__idproxy/explain を使える
+	AdminRoles string `env:"ADMIN_ROLES,optional"`
+
+	// assertion の署名に使う RSA の秘密鍵の PEM。複数の鍵を書いた場合は先頭の鍵で署名する。assertion を書いたサイトがある場合は必須
+	AssertionKeyPath string `env:"ASSERTION_KEY_PATH,optional"`
+	// assertion の iss。省略した場合は id-proxy
+	AssertionIssuer string `env:"ASSERTION_ISSUER,optional"`
 }
 
 var env envType
 
-//go:embed list.yml
-var listYml string
+const defaultListPath = "list.yml"
 
 func init() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+}
+
+func initServer() {
 	readenv.Read(&env)
+	if env.ListPath == "" {
+		env.ListPath = defaultListPath
+	}
+
 	if err := oidc.InitializeDiscovery(env.OIDCIssuer); err != nil {
 		panic(err)
 	}
 
 	kvs.Init(env.RedisHost, env.RedisPrefix)
-	access.Initialize(listYml)
+	if err := initSigningKeys(); err != nil {
+		panic(err)
+	}
+	registerLoadChecks()
+	access.OnLoad(buildSiteProxies)
+	if err := access.Load(env.ListPath); err != nil {
+		panic(err)
+	}
+}
 
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+// registerLoadChecks は設定を読み込むときの確認を登録する。validate でも同じ確認をする。
+func registerLoadChecks() {
+	access.OnLoad(checkSigningKeys)
+}
+
+func watchList() {
+	access.Watch(env.ListPath, 10*time.Second)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			access.Reload(env.ListPath)
+		}
+	}()
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
+	initServer()
+	watchList()
+
 	router.Get("/__idproxy/logout", func(w http.ResponseWriter, r *http.Request) {
-		http.SetCookie(w, &http.Cookie{
-			Name:     "__idproxy",
-			Value:    "",
-			MaxAge:   -1,
-			Secure:   true,
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-			Path:     "/",
-		})
+		if c, err := r.Cookie("__idproxy"); err == nil {
+			EndSession(CalculateSession(c.Value))
+		}
+		setSessionCookie(w, "", -1)
 		w.WriteHeader(http.StatusOK)
 	})
 
@@ -60,57 +106,162 @@ func main() {
 		handleOIDCCallback(w, r)
 	})
 
+	router.Get("/__idproxy/jwks.json", handleJWKS)
+
+	router.Get("/__idproxy/explain", func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Host = r.Host
+		handleExplain(w, r)
+	})
+
 	router.All("/*", func(w http.ResponseWriter, r *http.Request) {
 		r.URL.Host = r.Host
 
+		if err := access.CanonicalizeURL(r.URL); err != nil {
+			log.Println(err, r.URL.EscapedPath())
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "不正なパス")
+			return
+		}
+
+		// リロードと重なっても同じ設定で判定する
+		conf := access.Current()
+		site, err := conf.SiteConfig(*r.URL)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "URL に対応するコンフィグが投入されていない")
+			return
+		}
+
+		req := access.Request{
+			URL:      *r.URL,
+			Method:   r.Method,
+			ClientIP: access.ClientIP(r.RemoteAddr, r.Header.Values("X-Forwarded-For")),
+		}
+
+		if d := access.CheckSite(req, site); d != access.Allowed {
+			writeDecision(w, d, site)
+			return
+		}
+
+		mode := conf.AuthModeFor(req, site)
+		if mode == access.AuthPublic {
+			proxy(w, r, site, nil)
+			return
+		}
+
 		c, err := r.Cookie("__idproxy")
 		if err != nil {
+			if mode == access.AuthOptional {
+				proxy(w, r, site, nil)
+				return
+			}
 			log.Println("Cookie がないのでリダイレクト")
 			startSessionAndRedirect(w, r)
 			return
 		}
 
-		accessMap, ok := GetAccessMap(CalculateSession(c.Value))
+		s, ok := GetSession(CalculateSession(c.Value))
 		if !ok {
-			log.Println("accessMap がないのでリダイレクト")
+			if mode == access.AuthOptional {
+				proxy(w, r, site, nil)
+				return
+			}
+			log.Println("セッションがないのでリダイレクト")
 			startSessionAndRedirect(w, r)
 			return
 		}
 
-		canAccess := access.CanAccess(*r.URL, accessMap)
-
-		if !canAccess {
-			w.WriteHeader(http.StatusForbidden)
-			io.WriteString(w, "アクセス権限がありません")
-			return
+		if s.needsRefresh() {
+			err := refreshSession(s)
+			if errors.Is(err, ErrSessionEnded) {
+				if mode == access.AuthOptional {
+					proxy(w, r, site, nil)
+					return
+				}
+				log.Println("IdP 側でセッションが終わっているのでリダイレクト", s.Sub)
+				startSessionAndRedirect(w, r)
+				return
+			}
+			if err != nil {
+				// IdP に繋がらない間は、今のセッションのまま通す
+				log.Println("セッションを更新できなかった", s.Sub, err)
+			} else {
+				setSessionCookie(w, c.Value, s.remainingSec())
+			}
 		}
 
-		u, _ := url.Parse(access.BackendURL(*r.URL))
-
-		site, err := access.SiteConfig(*r.URL)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusBadRequest)
-			io.WriteString(w, "URL に対応するコンフィグが投入されていない")
+		if d := conf.CanAccess(req, site, s.Identity()); d != access.Allowed {
+			if mode == access.AuthOptional {
+				// 権限がないユーザーは未ログインとして扱う
+				proxy(w, r, site, nil)
+				return
+			}
+			log.Println("アクセス拒否", s.Sub, r.URL.String())
+			writeDecision(w, d, site)
 			return
 		}
 
-		rp := &httputil.ReverseProxy{
-			Rewrite: func(pr *httputil.ProxyRequest) {
-				pr.SetURL(u)
-				if site.DisguiseHostHeader {
-					// リクエスト本来の Host ヘッダーに偽装する
-					pr.Out.Host = pr.In.Host
-				}
-			},
+		if site.PassAccessToken && !refreshAccessToken(s) {
+			if mode == access.AuthRequired {
+				// ログインし直してアクセストークンを取り直す
+				log.Println("アクセストークンがないのでリダイレクト", s.Sub)
+				startSessionAndRedirect(w, r)
+				return
+			}
 		}
-		rp.ServeHTTP(w, r)
+
+		proxy(w, r, site, s)
 	})
 
 	log.Println("http://localhost:8080/")
 	http.ListenAndServe(":8080", router.Handler())
 }
 
+// runCommand はサーバーを起動せずにサブコマンドを実行し、終了コードを返す。
+func runCommand(name string, args []string) int {
+	switch name {
+	case "validate":
+		return runValidate(args)
+	case "explain":
+		return runExplain(args)
+	case "matrix":
+		return runMatrix(args)
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command: %s\n", name)
+	fmt.Fprintln(os.Stderr, "usage: id-proxy [validate [options] [list.yml] | explain [options] URL | matrix [options] [list.yml]]")
+	return 2
+}
+
+func writeDecision(w http.ResponseWriter, d access.Decision, site *access.Site) {
+	switch d {
+	case access.MethodNotAllowed:
+		w.Header().Set("Allow", strings.Join(site.Methods, ", "))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "許可されていないメソッドです")
+	case access.NotYetOpen:
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "まだ公開されていません。公開開始: "+site.NotBefore.Format(time.RFC3339))
+	case access.AlreadyClosed:
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "公開は終了しました。公開終了: "+site.NotAfter.Format(time.RFC3339))
+	case access.OutsideSchedule:
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "公開時間外です")
+	case access.NetworkDenied:
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "このネットワークからはアクセスできません")
+	default:
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "アクセス権限がありません")
+	}
+}
+
+func proxy(w http.ResponseWriter, r *http.Request, site *access.Site, s *Session) {
+	proxyFor(site).ServeHTTP(w, r, s)
+}
+
 func startSessionAndRedirect(w http.ResponseWriter, r *http.Request) {
 	redirectUri, _ := url.JoinPath(r.URL.Host, "/__idproxy/callback")
 
@@ -126,17 +277,22 @@ func startSessionAndRedirect(w http.ResponseWriter, r *http.Request) {
 
 	SaveOriginalUrl(state, r.URL.String())
 
+	// ログインが終わったら、セッションの有効期間に合わせて設定し直す
+	setSessionCookie(w, s, sessionLifetimeSec)
+	w.Header().Add("Location", u)
+	w.WriteHeader(http.StatusFound)
+}
+
+func setSessionCookie(w http.ResponseWriter, value string, maxAge int) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     "__idproxy",
-		Value:    s,
-		MaxAge:   3 * 24 * 3600,
+		Value:    value,
+		MaxAge:   maxAge,
 		Secure:   true,
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
 		Path:     "/",
 	})
-	w.Header().Add("Location", u)
-	w.WriteHeader(http.StatusFound)
 }
 
 func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
@@ -158,7 +314,7 @@ func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	redirectUri, _ := url.JoinPath(r.URL.Host, "/__idproxy/callback")
-	payload, err := oidc.CallbackCode(CalculateSession(co.Value), toQueryMap(r), env.OIDCClientID, env.OIDCClientSecret, "https://"+redirectUri)
+	payload, token, err := oidc.CallbackCode(CalculateSession(co.Value), toQueryMap(r), env.OIDCClientID, env.OIDCClientSecret, "https://"+redirectUri)
 	if err != nil {
 		log.Println(err)
 		io.WriteString(w, "err")
@@ -166,9 +322,9 @@ func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Println(payload)
 
-	accessMap := access.GetAccessMap(payload.Roles)
-	log.Println(accessMap)
-	SaveAccessMap(CalculateSession(co.Value), accessMap)
+	session := NewSession(*payload, *token)
+	SaveSession(CalculateSession(co.Value), session)
+	setSessionCookie(w, co.Value, session.remainingSec())
 
 	state, ok := toQueryMap(r)["state"]
 	if !ok {
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/comame/id-proxy/access"
+)
+
+// runMatrix はロールとサイトの組み合わせごとのアクセス可否を表示する。
+func runMatrix(args []string) int {
+	fs := flag.NewFlagSet("matrix", flag.ContinueOnError)
+	format := fs.String("format", "table", "出力形式 (table, csv, json)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: id-proxy matrix [options] [list.yml]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	l, err := access.ParsePath(listPathFromArgs(fs.Args()))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	m := access.BuildMatrix(l)
+	switch *format {
+	case "table":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		writeMatrix(m, func(record []string) error {
+			_, err := fmt.Fprintln(tw, strings.Join(record, "\t"))
+			return err
+		})
+		tw.Flush()
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		writeMatrix(m, w.Write)
+		w.Flush()
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(m)
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
+
+func writeMatrix(m access.Matrix, write func(record []string) error) error {
+	header := append([]string{"SITE", "HOST", "PATH", "AUTH"}, m.Roles...)
+	header = append(header, "CONDITIONS")
+	if err := write(header); err != nil {
+		return err
+	}
+
+	for _, row := range m.Rows {
+		record := []string{row.Site, row.Host, row.Path, string(row.Auth)}
+		for _, role := range m.Roles {
+			methods := row.Access[role]
+			if len(methods) == 0 {
+				record = append(record, "-")
+			} else {
+				record = append(record, strings.Join(methods, ","))
+			}
+		}
+		record = append(record, strings.Join(row.Conditions, "; "))
+		if err := write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
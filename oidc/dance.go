@@ -22,6 +22,9 @@ var (
 	ErrTokenRequestFailed          = errors.New("token request failed")
 	ErrInvalidIdToken              = errors.New("id_token validation failed")
 	ErrInvalidSession              = errors.New("invalid session")
+	// ErrRefreshTokenRejected は IdP がリフレッシュトークンを受け付けなかったことを表す。ユーザーのセッションは IdP 側で終わっている
+	ErrRefreshTokenRejected = errors.New("refresh token rejected")
+	ErrRevocationFailed     = errors.New("token revocation failed")
 )
 
 func GenerateAuthenticationRequestUrl(session string, clientId string, redirectUri string) (redirectUrl, state string, err error) {
@@ -40,8 +43,14 @@ func GenerateAuthenticationRequestUrl(session string, clientId string, redirectU
 		return "", "", err
 	}
 
+	scope := "openid"
+	if d.SupportsRefreshToken() {
+		// IdP がセッションを続けているかを確かめたり、ロールを読み直したりするのにリフレッシュトークンを使う
+		scope += " offline_access"
+	}
+
 	q := u.Query()
-	q.Add("scope", "openid")
+	q.Add("scope", scope)
 	q.Add("response_type", "code")
 	q.Add("client_id", clientId)
 	q.Add("redirect_uri", redirectUri)
@@ -60,33 +69,33 @@ func CallbackCode(
 	session string,
 	callbackQuery map[string]string,
 	clientId, clientSecret, redirectUri string,
-) (*jwt.Payload, error) {
+) (*jwt.Payload, *TokenResponse, error) {
 	qerr, ok := callbackQuery["error"]
 	if ok {
-		return nil, errors.New(qerr)
+		return nil, nil, errors.New(qerr)
 	}
 
 	code, ok := callbackQuery["code"]
 	if !ok {
-		return nil, ErrMissingCode
+		return nil, nil, ErrMissingCode
 	}
 	state, ok := callbackQuery["state"]
 	if !ok {
-		return nil, ErrMissingState
+		return nil, nil, ErrMissingState
 	}
 
 	// state の検証
 	savedState, err := kvs.Get("state:" + session)
 	if err != nil {
-		return nil, fmt.Errorf("state が kvs に保存されていない %w", err)
+		return nil, nil, fmt.Errorf("state が kvs に保存されていない %w", err)
 	}
 	if savedState != state {
-		return nil, fmt.Errorf("state が違う expect:%s, got:%s", savedState, state)
+		return nil, nil, fmt.Errorf("state が違う expect:%s, got:%s", savedState, state)
 	}
 
 	nonce, err := kvs.Get("nonce:" + session)
 	if err != nil {
-		return nil, fmt.Errorf("nonce がない %w", err)
+		return nil, nil, fmt.Errorf("nonce がない %w", err)
 	}
 	defer func() {
 		kvs.Del("nonce:" + session)
@@ -94,19 +103,44 @@ func CallbackCode(
 
 	tokenResponse, err := tokenRequest(code, clientId, clientSecret, redirectUri)
 	if err != nil {
-		return nil, ErrTokenRequestFailed
+		return nil, nil, ErrTokenRequestFailed
 	}
 
 	idToken := tokenResponse.IdToken
 	payload, err := validateIdToken(idToken, nonce)
 	if err != nil {
-		return nil, ErrInvalidIdToken
+		return nil, nil, ErrInvalidIdToken
 	}
 
-	return payload, nil
+	return payload, tokenResponse, nil
 }
 
 func validateIdToken(idToken, nonce string) (*jwt.Payload, error) {
+	payload, err := verifyIdToken(idToken)
+	if err != nil {
+		return nil, err
+	}
+	if payload.Nonce != nonce {
+		return nil, errors.New("invalid nonce")
+	}
+
+	return payload, nil
+}
+
+// ValidateRefreshedIdToken はリフレッシュで得た ID Token を検証する。リフレッシュでは nonce を送らないので、代わりに sub が変わっていないことを確かめる。
+func ValidateRefreshedIdToken(idToken, sub string) (*jwt.Payload, error) {
+	payload, err := verifyIdToken(idToken)
+	if err != nil {
+		return nil, err
+	}
+	if payload.Sub != sub {
+		return nil, errors.New("sub changed")
+	}
+
+	return payload, nil
+}
+
+func verifyIdToken(idToken string) (*jwt.Payload, error) {
 	jwk := GetJWK()
 	if len(jwk.Keys) != 1 {
 		return nil, ErrSingleKeyIsSupported
@@ -130,9 +164,6 @@ func validateIdToken(idToken, nonce string) (*jwt.Payload, error) {
 	if payload.Aud != "id-proxy.comame.xyz" {
 		return nil, errors.New("invalid aud")
 	}
-	if payload.Nonce != nonce {
-		return nil, errors.New("invalid nonce")
-	}
 
 	now := uint64(time.Now().Unix())
 	if now > payload.Exp {
@@ -146,7 +177,23 @@ func validateIdToken(idToken, nonce string) (*jwt.Payload, error) {
 }
 
 type TokenResponse struct {
-	IdToken string `json:"id_token"`
+	IdToken     string `json:"id_token"`
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	// ExpiresIn はアクセストークンの有効期間 (秒)。IdP が返さない場合は 0
+	ExpiresIn    uint64 `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	// リフレッシュトークンの有効期間 (秒)。標準ではないので、IdP によってどちらかを返すか、どちらも返さない
+	RefreshExpiresIn      uint64 `json:"refresh_expires_in"`
+	RefreshTokenExpiresIn uint64 `json:"refresh_token_expires_in"`
+}
+
+// RefreshLifetime はリフレッシュトークンの有効期間 (秒) を返す。わからない場合は 0 を返す。
+func (t *TokenResponse) RefreshLifetime() uint64 {
+	if t.RefreshExpiresIn > 0 {
+		return t.RefreshExpiresIn
+	}
+	return t.RefreshTokenExpiresIn
 }
 
 func tokenRequest(code, clientId, clientSecret, redirectUri string) (*TokenResponse, error) {
@@ -158,6 +205,92 @@ func tokenRequest(code, clientId, clientSecret, redirectUri string) (*TokenRespo
 	q.Add("client_secret", clientSecret)
 	q.Add("redirect_uri", redirectUri)
 
+	tokenResponse, err := postTokenEndpoint(q)
+	if err != nil {
+		return nil, err
+	}
+	// 明らかになんか短い
+	if len(tokenResponse.IdToken) <= 5 {
+		return nil, errors.New("invalid TokenEndpoint response format")
+	}
+
+	return tokenResponse, nil
+}
+
+// RefreshAccessToken はリフレッシュトークンでアクセストークンを取り直す。
+// IdP が新しいリフレッシュトークンを返さなかった場合、TokenResponse.RefreshToken は空になる。
+func RefreshAccessToken(refreshToken, clientId, clientSecret string) (*TokenResponse, error) {
+	q := make(url.Values)
+
+	q.Add("grant_type", "refresh_token")
+	q.Add("refresh_token", refreshToken)
+	q.Add("client_id", clientId)
+	q.Add("client_secret", clientSecret)
+
+	tokenResponse, err := postTokenEndpoint(q)
+	var terr *tokenEndpointError
+	if errors.As(err, &terr) && (terr.status == http.StatusBadRequest || terr.status == http.StatusUnauthorized) {
+		// invalid_grant などで、リフレッシュトークンが受け付けられなかった
+		return nil, fmt.Errorf("%w: %s", ErrRefreshTokenRejected, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tokenResponse.AccessToken == "" {
+		return nil, ErrTokenRequestFailed
+	}
+
+	return tokenResponse, nil
+}
+
+// RevokeRefreshToken は IdP にリフレッシュトークンを無効にさせる (RFC 7009)。IdP が対応していない場合は何もしない。
+func RevokeRefreshToken(refreshToken, clientId, clientSecret string) error {
+	d := GetDiscovery()
+	if d.RevocationEndpoint == "" {
+		return nil
+	}
+
+	q := make(url.Values)
+	q.Add("token", refreshToken)
+	q.Add("token_type_hint", "refresh_token")
+	q.Add("client_id", clientId)
+	q.Add("client_secret", clientSecret)
+
+	req, err := http.NewRequest(http.MethodPost, d.RevocationEndpoint, strings.NewReader(q.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// 無効なトークンに対しても 200 を返す決まりなので、それ以外は失敗とみなす
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%w: %d %s", ErrRevocationFailed, res.StatusCode, b)
+	}
+	return nil
+}
+
+// tokenEndpointError はトークンエンドポイントが 200 以外を返したことを表す
+type tokenEndpointError struct {
+	status int
+	body   string
+}
+
+func (e *tokenEndpointError) Error() string {
+	return fmt.Sprintf("%s: %d %s", ErrTokenRequestFailed, e.status, e.body)
+}
+
+func (e *tokenEndpointError) Unwrap() error {
+	return ErrTokenRequestFailed
+}
+
+func postTokenEndpoint(q url.Values) (*TokenResponse, error) {
 	d := GetDiscovery()
 	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(q.Encode()))
 	if err != nil {
@@ -169,20 +302,21 @@ func tokenRequest(code, clientId, clientSecret, redirectUri string) (*TokenRespo
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
 
 	resb, err := io.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
 
+	if res.StatusCode != http.StatusOK {
+		return nil, &tokenEndpointError{status: res.StatusCode, body: string(resb)}
+	}
+
 	var tokenResponse TokenResponse
 	if err := json.Unmarshal(resb, &tokenResponse); err != nil {
 		return nil, err
 	}
-	// 明らかになんか短い
-	if len(tokenResponse.IdToken) <= 5 {
-		return nil, errors.New("invalid TokenEndpoint response format")
-	}
 
 	return &tokenResponse, nil
 }
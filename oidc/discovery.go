@@ -20,6 +20,14 @@ type Discovery struct {
 	IdTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
 	TokenEndpointAuthMethodSupported []string `json:"token_endpoint_auth_methods_supported"`
 	GrantTypesSupported              []string `json:"grant_types_supported"`
+	ScopesSupported                  []string `json:"scopes_supported"`
+	// RFC 7009 のトークン失効エンドポイント。IdP が対応していない場合は空
+	RevocationEndpoint string `json:"revocation_endpoint"`
+}
+
+// SupportsRefreshToken は IdP がリフレッシュトークンを発行するかどうかを返す。
+func (d Discovery) SupportsRefreshToken() bool {
+	return slices.Contains(d.ScopesSupported, "offline_access") && slices.Contains(d.GrantTypesSupported, "refresh_token")
 }
 
 var (
@@ -30,6 +38,7 @@ var (
 	ErrInvalidAuthorizationEndpointFormat               = errors.New("invalid authorization_endpoint format")
 	ErrInvalidTokenEndpointFormat                       = errors.New("invalid token_endpoint format")
 	ErrInvalidJwksUriFormat                             = errors.New("invalid jwks_uri format")
+	ErrInvalidRevocationEndpointFormat                  = errors.New("invalid revocation_endpoint format")
 	ErrIdTokenSigningAlgValuesSupportedUnsupportedValue = errors.New("id_token_signing_alg_values_supported value is unsupported")
 	ErrTokenEndpointAuthMethodSupportedUnsupportedValue = errors.New("token_endpoint_auth_methods_supported value is unsupported")
 	ErrGrantTypesSupportedUnsupportedValue              = errors.New("grant_types_supported value is unsupported")
@@ -129,6 +138,9 @@ func validateDiscovery(value Discovery) error {
 	if _, err := url.Parse(value.JwksURI); err != nil {
 		return ErrInvalidJwksUriFormat
 	}
+	if _, err := url.Parse(value.RevocationEndpoint); err != nil {
+		return ErrInvalidRevocationEndpointFormat
+	}
 
 	if !slices.Contains(value.IdTokenSigningAlgValuesSupported, "RS256") {
 		return ErrIdTokenSigningAlgValuesSupportedUnsupportedValue
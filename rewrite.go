@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/comame/id-proxy/access"
+)
+
+// restoreResponsePaths はバックエンドが返した Location と Set-Cookie の Path を公開側のパスに戻す。
+func restoreResponsePaths(res *http.Response, site *access.Site, backend *url.URL) {
+	if loc := res.Header.Get("Location"); loc != "" {
+		res.Header.Set("Location", restoreLocation(loc, site, backend, res.Request.Host))
+	}
+
+	cookies := res.Header.Values("Set-Cookie")
+	for i, c := range cookies {
+		cookies[i] = restoreCookiePath(c, site)
+	}
+}
+
+func restoreLocation(loc string, site *access.Site, backend *url.URL, publicHost string) string {
+	u, err := url.Parse(loc)
+	if err != nil || (u.Host == "" && !strings.HasPrefix(u.Path, "/")) {
+		// 相対パスはバックエンドのパス構造のまま解決されるので触らない
+		return loc
+	}
+	if u.Host != "" {
+		if strings.EqualFold(u.Host, backend.Host) {
+			// バックエンド自身の URL は外から見えないので、ホストを落として公開側で解決させる
+			u.Scheme = ""
+			u.Host = ""
+		} else if !strings.EqualFold(u.Host, publicHost) {
+			return loc
+		}
+	}
+	u.Path = site.PublicPath(u.Path)
+	u.RawPath = ""
+	return u.String()
+}
+
+func restoreCookiePath(cookie string, site *access.Site) string {
+	attrs := strings.Split(cookie, ";")
+	for i, a := range attrs {
+		k, v, ok := strings.Cut(strings.TrimSpace(a), "=")
+		if i == 0 || !ok || !strings.EqualFold(k, "path") || !strings.HasPrefix(v, "/") {
+			continue
+		}
+		p := site.PublicPath(v)
+		if len(p) > 1 {
+			p = strings.TrimSuffix(p, "/")
+		}
+		attrs[i] = " Path=" + p
+	}
+	return strings.Join(attrs, ";")
+}
@@ -3,12 +3,142 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/comame/id-proxy/access"
+	"github.com/comame/id-proxy/jwt"
 	"github.com/comame/id-proxy/kvs"
+	"github.com/comame/id-proxy/oidc"
 	"github.com/comame/id-proxy/random"
 )
 
+// sessionLifetimeSec は IdP がリフレッシュトークンの有効期間を返さない場合のセッションの有効期間
+const sessionLifetimeSec = 3 * 24 * 3600
+
+const (
+	// リフレッシュトークンがあるセッションは refreshIntervalSec ごとに IdP に問い合わせ、ロールの変更や IdP 側のログアウトを反映する
+	refreshIntervalSec = 10 * 60
+	// IdP に繋がらなかった場合は、refreshRetrySec 後にもう一度問い合わせる
+	refreshRetrySec = 60
+)
+
+// ErrSessionEnded は IdP がリフレッシュトークンを受け付けず、セッションを終わらせたことを表す
+var ErrSessionEnded = errors.New("session ended by IdP")
+
+// Session は検証済みの ID Token から得たユーザーの情報を保持する。
+// アクセスできるかどうかはリクエストごとに Roles から計算するので、設定を変えてもログインし直す必要はない。
+type Session struct {
+	Sub   string   `json:"sub"`
+	Roles []string `json:"roles"`
+
+	// IdP 側のセッション ID
+	Sid string `json:"sid"`
+	// ID Token のすべてのクレーム
+	Claims map[string]any `json:"claims"`
+
+	IssuedAt  uint64 `json:"iat"`
+	ExpiresAt uint64 `json:"exp"`
+
+	// passAccessToken のサイトに送るアクセストークン。AccessTokenExpiresAt が 0 の場合は有効期限がわからない
+	AccessToken          string `json:"access_token,omitempty"`
+	AccessTokenExpiresAt uint64 `json:"access_token_exp,omitempty"`
+	// トークンレスポンスの token_type。Bearer 以外はバックエンドに送らない
+	AccessTokenType string `json:"access_token_type,omitempty"`
+	// アクセストークンを取り直すのに使う。ブラウザには渡さない
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// 次にリフレッシュトークンで IdP に問い合わせる時刻
+	NextRefreshAt uint64 `json:"next_refresh_at,omitempty"`
+
+	// kvs のキー
+	key string
+}
+
+func NewSession(payload jwt.Payload, token oidc.TokenResponse) Session {
+	s := Session{
+		Sub:       payload.Sub,
+		Roles:     payload.Roles,
+		Sid:       payload.Sid,
+		Claims:    payload.Claims,
+		IssuedAt:  payload.Iat,
+		ExpiresAt: uint64(time.Now().Unix()) + sessionLifetimeSec,
+	}
+	s.setTokens(token)
+	return s
+}
+
+// setTokens はトークンレスポンスのアクセストークンとリフレッシュトークンを保存する。
+// リフレッシュトークンがある間は IdP のポリシーに合わせてセッションを延ばす。
+func (s *Session) setTokens(token oidc.TokenResponse) {
+	now := uint64(time.Now().Unix())
+
+	s.AccessToken = token.AccessToken
+	s.AccessTokenType = token.TokenType
+	if token.AccessToken != "" && !strings.EqualFold(token.TokenType, "Bearer") {
+		log.Println("Bearer でないアクセストークンはバックエンドに送らない", s.Sub, token.TokenType)
+	}
+	s.AccessTokenExpiresAt = 0
+	if token.ExpiresIn > 0 {
+		s.AccessTokenExpiresAt = now + token.ExpiresIn
+	}
+
+	// リフレッシュトークンを返さない IdP では、前のものを使い続ける
+	if token.RefreshToken != "" {
+		s.RefreshToken = token.RefreshToken
+		s.ExpiresAt = now + sessionLifetimeSec
+	}
+	if lifetime := token.RefreshLifetime(); lifetime > 0 {
+		s.ExpiresAt = now + lifetime
+	}
+	if s.RefreshToken != "" {
+		s.NextRefreshAt = now + refreshIntervalSec
+	}
+}
+
+// needsRefresh は IdP に問い合わせる時刻を過ぎているかどうかを返す。
+func (s *Session) needsRefresh() bool {
+	return s.RefreshToken != "" && uint64(time.Now().Unix()) >= s.NextRefreshAt
+}
+
+// remainingSec はセッションの残りの有効期間 (秒) を返す。
+func (s *Session) remainingSec() int {
+	now := uint64(time.Now().Unix())
+	if s.ExpiresAt <= now {
+		return 0
+	}
+	return int(s.ExpiresAt - now)
+}
+
+// accessTokenMargin はアクセストークンが期限切れ間近とみなす残り時間 (秒)。バックエンドが使う間に切れないようにする。
+const accessTokenMargin = 30
+
+// hasValidAccessToken はアクセストークンが当面使えるかどうかを返す。
+func (s *Session) hasValidAccessToken() bool {
+	if s.AccessToken == "" {
+		return false
+	}
+	return s.AccessTokenExpiresAt == 0 || uint64(time.Now().Unix())+accessTokenMargin < s.AccessTokenExpiresAt
+}
+
+// bearerToken はバックエンドに Bearer として送れるアクセストークンを返す。
+func (s *Session) bearerToken() (string, bool) {
+	if !s.hasValidAccessToken() || !strings.EqualFold(s.AccessTokenType, "Bearer") {
+		return "", false
+	}
+	return s.AccessToken, true
+}
+
+func (s *Session) Identity() access.Identity {
+	return access.Identity{
+		Roles:  s.Roles,
+		Claims: s.Claims,
+	}
+}
+
 func CreateCookieValue() (string, error) {
 	r, err := random.String(16)
 	if err != nil {
@@ -17,27 +147,137 @@ func CreateCookieValue() (string, error) {
 	return r, nil
 }
 
+// CalculateSession は Cookie の値から kvs のキーを作る。
+// 以前は設定のハッシュを混ぜて ACCESS: にサイトの位置を保存していたが、ロールを持たないので SESSION: には移せない。
+// そのため古いセッションは引き継がず、ログインし直してもらう。残った ACCESS: のキーは有効期限で消える。
 func CalculateSession(cookie string) string {
-	l := access.CalculateListHash()
-	b := sha256.Sum256([]byte(cookie + "." + l))
+	b := sha256.Sum256([]byte(cookie))
 	return hex.EncodeToString(b[:])
 }
 
-func SaveAccessMap(session, accessMap string) error {
-	k := "ACCESS:" + session
-	if err := kvs.Set(k, accessMap, 3*24*3600); err != nil {
+func SaveSession(session string, s Session) error {
+	k := "SESSION:" + session
+	v, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	ttl := s.remainingSec()
+	if ttl == 0 {
+		return nil
+	}
+	if err := kvs.Set(k, string(v), uint(ttl)); err != nil {
 		return err
 	}
 	return nil
 }
 
-func GetAccessMap(session string) (string, bool) {
-	k := "ACCESS:" + session
+func DeleteSession(session string) {
+	kvs.Del("SESSION:" + session)
+}
+
+// EndSession はログアウトしたユーザーのセッションを消し、IdP が対応していればリフレッシュトークンを無効にする。
+func EndSession(session string) {
+	s, ok := GetSession(session)
+	DeleteSession(session)
+	if !ok || s.RefreshToken == "" {
+		return
+	}
+	if err := oidc.RevokeRefreshToken(s.RefreshToken, env.OIDCClientID, env.OIDCClientSecret); err != nil {
+		log.Println("リフレッシュトークンを無効にできなかった", s.Sub, err)
+	}
+}
+
+func GetSession(session string) (*Session, bool) {
+	k := "SESSION:" + session
 	v, err := kvs.Get(k)
 	if err != nil {
-		return "", false
+		return nil, false
+	}
+
+	var s Session
+	if err := json.Unmarshal([]byte(v), &s); err != nil {
+		return nil, false
+	}
+	if uint64(time.Now().Unix()) > s.ExpiresAt {
+		return nil, false
+	}
+	s.key = session
+
+	return &s, true
+}
+
+// UpdateSession は有効期限を変えずにセッションを書き換える。
+func UpdateSession(s *Session) error {
+	k := "SESSION:" + s.key
+	v, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return kvs.Update(k, string(v))
+}
+
+// refreshLocks はセッションごとに、IdP への問い合わせを同時に一つだけにする
+var refreshLocks sync.Map
+
+// refreshSession はリフレッシュトークンでトークンを取り直し、ID Token が返ってきた場合はロールとクレームを読み直す。
+// IdP がリフレッシュトークンを受け付けなかった場合はセッションを消し、ErrSessionEnded を返す。
+func refreshSession(s *Session) error {
+	mu, _ := refreshLocks.LoadOrStore(s.key, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer func() {
+		mu.(*sync.Mutex).Unlock()
+		refreshLocks.Delete(s.key)
+	}()
+
+	// 待っている間に別のリクエストが問い合わせていれば、その結果を使う
+	latest, ok := GetSession(s.key)
+	if !ok {
+		return ErrSessionEnded
+	}
+	if latest.NextRefreshAt != s.NextRefreshAt {
+		*s = *latest
+		return nil
+	}
+
+	token, err := oidc.RefreshAccessToken(s.RefreshToken, env.OIDCClientID, env.OIDCClientSecret)
+	if errors.Is(err, oidc.ErrRefreshTokenRejected) {
+		log.Println("IdP がリフレッシュトークンを受け付けなかったので、セッションを終わらせる", s.Sub, err)
+		DeleteSession(s.key)
+		return ErrSessionEnded
+	}
+	if err == nil && token.IdToken != "" {
+		var payload *jwt.Payload
+		if payload, err = oidc.ValidateRefreshedIdToken(token.IdToken, s.Sub); err == nil {
+			s.Roles = payload.Roles
+			s.Claims = payload.Claims
+		}
+	}
+	if err != nil {
+		s.NextRefreshAt = uint64(time.Now().Unix()) + refreshRetrySec
+		if uerr := UpdateSession(s); uerr != nil {
+			log.Println(uerr)
+		}
+		return err
+	}
+
+	s.setTokens(*token)
+	return SaveSession(s.key, *s)
+}
+
+// refreshAccessToken は必要ならリフレッシュトークンでアクセストークンを取り直し、使えるアクセストークンがあるかどうかを返す。
+func refreshAccessToken(s *Session) bool {
+	if s.hasValidAccessToken() {
+		return true
+	}
+	if s.RefreshToken == "" {
+		return false
+	}
+
+	if err := refreshSession(s); err != nil {
+		log.Println("アクセストークンを取り直せなかった", s.Sub, err)
+		return false
 	}
-	return v, true
+	return s.hasValidAccessToken()
 }
 
 func SaveOriginalUrl(state, uri string) {
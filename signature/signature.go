@@ -0,0 +1,124 @@
+// Package signature は id-proxy がバックエンドへのリクエストに付ける HMAC 署名を作り、検証する。
+// JWT を検証できないバックエンドは、id-proxy と共有した鍵で Verify を呼ぶだけで、id-proxy を経由したリクエストかどうかと、
+// ユーザーの情報のヘッダーが書き換えられていないかを確かめられる。
+//
+// 署名の対象はメソッド、パスとクエリ、タイムスタンプ、SignedHeadersHeader に並べたヘッダーで、ボディは含まない。
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TimestampHeader は署名した時刻の UNIX 秒
+	TimestampHeader = "X-Idproxy-Timestamp"
+	// SignedHeadersHeader は署名に含めたヘッダーの名前をセミコロン区切りで並べたもの
+	SignedHeadersHeader = "X-Idproxy-Signed-Headers"
+	// SignatureHeader は HMAC-SHA256 の署名を 16 進数にしたもの
+	SignatureHeader = "X-Idproxy-Signature"
+)
+
+// DefaultWindow は Verify で受け付ける、署名した時刻とのずれ
+const DefaultWindow = 5 * time.Minute
+
+var (
+	ErrMissingSignature = errors.New("missing signature")
+	ErrInvalidTimestamp = errors.New("invalid timestamp")
+	ErrExpired          = errors.New("signature is outside the replay window")
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// Sign は r に署名し、署名のヘッダーを付ける。headers は署名に含めるヘッダーの名前で、r に入っているものだけを含める。
+func Sign(r *http.Request, key []byte, headers []string, now time.Time) {
+	var signed []string
+	for _, name := range headers {
+		if _, ok := r.Header[http.CanonicalHeaderKey(name)]; ok {
+			signed = append(signed, strings.ToLower(name))
+		}
+	}
+
+	ts := strconv.FormatInt(now.Unix(), 10)
+	r.Header.Set(TimestampHeader, ts)
+	r.Header.Set(SignedHeadersHeader, strings.Join(signed, ";"))
+	r.Header.Set(SignatureHeader, hex.EncodeToString(compute(key, r.Method, r.URL.RequestURI(), ts, signed, r.Header)))
+}
+
+// Verify は r の署名を検証する。window は署名した時刻とのずれの許容範囲で、0 の場合は DefaultWindow を使う。
+// 鍵を入れ替える間は、新旧の鍵を keys に渡す。
+//
+// タイムスタンプより後に同じリクエストを送り直されるのは防げないので、window はできるだけ短くする。
+// 署名に含まれないヘッダーは書き換えられているかもしれないので、ユーザーの情報は SignedHeader で読む。
+func Verify(r *http.Request, window time.Duration, keys ...[]byte) error {
+	sig := r.Header.Get(SignatureHeader)
+	ts := r.Header.Get(TimestampHeader)
+	if sig == "" || ts == "" {
+		return ErrMissingSignature
+	}
+
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+	if window == 0 {
+		window = DefaultWindow
+	}
+	d := time.Since(time.Unix(sec, 0))
+	if d > window || d < -window {
+		return ErrExpired
+	}
+
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	var signed []string
+	if v := r.Header.Get(SignedHeadersHeader); v != "" {
+		signed = strings.Split(v, ";")
+	}
+	for _, key := range keys {
+		if hmac.Equal(got, compute(key, r.Method, requestURI(r), ts, signed, r.Header)) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// SignedHeader は署名に含まれている場合に限り、ヘッダーの値を返す。Verify で検証したあとに使う。
+func SignedHeader(r *http.Request, name string) (string, bool) {
+	for _, n := range strings.Split(r.Header.Get(SignedHeadersHeader), ";") {
+		if n != "" && strings.EqualFold(n, name) {
+			return r.Header.Get(name), true
+		}
+	}
+	return "", false
+}
+
+func requestURI(r *http.Request) string {
+	// サーバー側では、送られてきたままの値と比べる
+	if r.RequestURI != "" {
+		return r.RequestURI
+	}
+	return r.URL.RequestURI()
+}
+
+func compute(key []byte, method, uri, ts string, signed []string, h http.Header) []byte {
+	var b strings.Builder
+	b.WriteString(method + "\n")
+	b.WriteString(uri + "\n")
+	b.WriteString(ts + "\n")
+	for _, name := range signed {
+		b.WriteString(name + ":" + strings.Join(h.Values(name), ",") + "\n")
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(b.String()))
+	return mac.Sum(nil)
+}
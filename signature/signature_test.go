@@ -0,0 +1,181 @@
+package signature
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var (
+	oldKey = []byte("old-secret")
+	newKey = []byte("new-secret")
+)
+
+// roundTrip はリクエストに signKey で署名し、tamper で書き換えてから httptest のサーバーに送る。
+// サーバーで SignedHeader で読んだ X-Forwarded-User と、Verify の結果を返す。
+func roundTrip(t *testing.T, signKey []byte, now time.Time, tamper func(r *http.Request), verifyKeys ...[]byte) (string, bool, error) {
+	t.Helper()
+
+	var verr error
+	var user string
+	var signed bool
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verr = Verify(r, 0, verifyKeys...)
+		user, signed = SignedHeader(r, "X-Forwarded-User")
+	}))
+	defer s.Close()
+
+	r, err := http.NewRequest(http.MethodGet, s.URL+"/app/page?a=1&b=2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("X-Forwarded-User", "alice")
+	r.Header.Set("X-Forwarded-Roles", "admin,dev")
+	Sign(r, signKey, []string{"X-Forwarded-User", "X-Forwarded-Roles", "X-Forwarded-Email"}, now)
+	if tamper != nil {
+		tamper(r)
+	}
+
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return user, signed, verr
+}
+
+func TestRoundTrip(t *testing.T) {
+	user, signed, err := roundTrip(t, newKey, time.Now(), nil, newKey)
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if !signed || user != "alice" {
+		t.Errorf("SignedHeader() = %q, %v, want alice, true", user, signed)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(r *http.Request)
+		want   error
+	}{
+		{"signed header changed", func(r *http.Request) { r.Header.Set("X-Forwarded-User", "mallory") }, ErrInvalidSignature},
+		{"signed header appended", func(r *http.Request) { r.Header.Add("X-Forwarded-Roles", "root") }, ErrInvalidSignature},
+		{"signed header removed", func(r *http.Request) { r.Header.Del("X-Forwarded-Roles") }, ErrInvalidSignature},
+		{"header removed from the signed list", func(r *http.Request) {
+			r.Header.Del("X-Forwarded-Roles")
+			r.Header.Set(SignedHeadersHeader, "x-forwarded-user")
+		}, ErrInvalidSignature},
+		{"unsigned header added to the signed list", func(r *http.Request) {
+			r.Header.Set("X-Forwarded-Email", "mallory@example.com")
+			r.Header.Set(SignedHeadersHeader, r.Header.Get(SignedHeadersHeader)+";x-forwarded-email")
+		}, ErrInvalidSignature},
+		{"path changed", func(r *http.Request) { r.URL.Path = "/admin" }, ErrInvalidSignature},
+		{"query changed", func(r *http.Request) { r.URL.RawQuery = "a=1&b=3" }, ErrInvalidSignature},
+		{"method changed", func(r *http.Request) { r.Method = http.MethodDelete }, ErrInvalidSignature},
+		{"timestamp changed within the window", func(r *http.Request) {
+			r.Header.Set(TimestampHeader, strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10))
+		}, ErrInvalidSignature},
+		{"signature malformed", func(r *http.Request) { r.Header.Set(SignatureHeader, "zz") }, ErrInvalidSignature},
+		{"signature removed", func(r *http.Request) { r.Header.Del(SignatureHeader) }, ErrMissingSignature},
+		{"timestamp removed", func(r *http.Request) { r.Header.Del(TimestampHeader) }, ErrMissingSignature},
+		{"timestamp moved outside the window", func(r *http.Request) { r.Header.Set(TimestampHeader, "1") }, ErrExpired},
+		{"timestamp malformed", func(r *http.Request) { r.Header.Set(TimestampHeader, "now") }, ErrInvalidTimestamp},
+	}
+
+	for _, tt := range tests {
+		_, _, err := roundTrip(t, newKey, time.Now(), tt.tamper, newKey)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: Verify() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyRotatedKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		signKey    []byte
+		verifyKeys [][]byte
+		want       error
+	}{
+		{"signed with the new key during rotation", newKey, [][]byte{newKey, oldKey}, nil},
+		{"signed with the old key during rotation", oldKey, [][]byte{newKey, oldKey}, nil},
+		{"signed with the old key after rotation", oldKey, [][]byte{newKey}, ErrInvalidSignature},
+		{"no keys", newKey, nil, ErrInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		_, _, err := roundTrip(t, tt.signKey, time.Now(), nil, tt.verifyKeys...)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: Verify() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyWindow(t *testing.T) {
+	// 送ってから検証するまでの時間を見込んで、境界から数秒離す
+	const margin = 5 * time.Second
+	tests := []struct {
+		name   string
+		offset time.Duration
+		want   error
+	}{
+		{"just inside the past edge", -DefaultWindow + margin, nil},
+		{"just outside the past edge", -DefaultWindow - margin, ErrExpired},
+		{"just inside the future edge", DefaultWindow - margin, nil},
+		{"just outside the future edge", DefaultWindow + margin, ErrExpired},
+	}
+
+	for _, tt := range tests {
+		_, _, err := roundTrip(t, newKey, time.Now().Add(tt.offset), nil, newKey)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: Verify() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyCustomWindow(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	Sign(r, newKey, nil, time.Now().Add(-2*time.Minute))
+	if err := Verify(r, time.Minute, newKey); !errors.Is(err, ErrExpired) {
+		t.Errorf("Verify() with 1m window error = %v, want %v", err, ErrExpired)
+	}
+	if err := Verify(r, 3*time.Minute, newKey); err != nil {
+		t.Errorf("Verify() with 3m window error = %v", err)
+	}
+}
+
+func TestSignedHeader(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Forwarded-User", "alice")
+	Sign(r, newKey, []string{"X-Forwarded-User", "X-Forwarded-Email"}, time.Now())
+	// 署名した後に足されたヘッダー
+	r.Header.Set("X-Forwarded-Email", "mallory@example.com")
+	r.Header.Set("X-Forwarded-Roles", "admin")
+
+	if err := Verify(r, 0, newKey); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	tests := []struct {
+		name   string
+		want   string
+		wantOK bool
+	}{
+		{"X-Forwarded-User", "alice", true},
+		{"x-forwarded-user", "alice", true},
+		// 署名に含めるよう頼んだが、署名の時点ではなかった
+		{"X-Forwarded-Email", "", false},
+		{"X-Forwarded-Roles", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := SignedHeader(r, tt.name)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("SignedHeader(%q) = %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/comame/id-proxy/access"
+	"github.com/comame/id-proxy/signature"
+	"github.com/comame/id-proxy/upstream"
+)
+
+// siteProxy はサイトごとのリバースプロキシ。設定を読み込むたびに作り直す。
+type siteProxy struct {
+	site *access.Site
+	pool *upstream.Pool
+	rp   *httputil.ReverseProxy
+}
+
+// proxyState はリクエストごとに、振り分け先のバックエンドとユーザー、エラーを ReverseProxy のフックに渡す
+type proxyState struct {
+	backend *upstream.Backend
+	// ログインしていないか、権限がない場合は nil
+	session *Session
+	err     error
+}
+
+type proxyStateKey struct{}
+
+func stateOf(ctx context.Context) *proxyState {
+	return ctx.Value(proxyStateKey{}).(*proxyState)
+}
+
+var (
+	siteProxiesMu sync.RWMutex
+	// サイトの ID ごとのリバースプロキシ
+	siteProxies = map[string]*siteProxy{}
+	// ひとつ前の設定のリバースプロキシ。プロキシを差し替えてから設定が差し替わるまでの間や、
+	// 差し替えの直前に古い設定でサイトを選んだリクエストが使う。次に読み込むまで残す。
+	prevSiteProxies = map[string]*siteProxy{}
+
+	// 設定が同じサイトは Transport を共有する。リロードしても keep-alive の接続を使い続けられるように、設定をまたいで残す。
+	// 定期的な読み込みと SIGHUP が重なることがあるので、作り直すのは同時に一つだけにする
+	buildMu    sync.Mutex
+	transports = map[access.Transport]*http.Transport{}
+)
+
+// strip はクライアントから受け取っても転送しないヘッダーの名前
+func newSiteProxy(site *access.Site, transport *http.Transport, strip []string) (*siteProxy, error) {
+	pool, err := upstream.NewPool(site)
+	if err != nil {
+		return nil, err
+	}
+
+	stripSet := make(map[string]bool, len(strip))
+	for _, name := range strip {
+		stripSet[headerKey(name)] = true
+	}
+
+	p := &siteProxy{site: site, pool: pool}
+	p.rp = &httputil.ReverseProxy{
+		Transport: transport,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			if site.RewritesPath() {
+				pr.Out.URL.Path = site.BackendPath(pr.Out.URL.Path)
+				pr.Out.URL.RawPath = ""
+			}
+			st := stateOf(pr.In.Context())
+			pr.SetURL(st.backend.URL)
+			if site.DisguiseHostHeader {
+				// リクエスト本来の Host ヘッダーに偽装する
+				pr.Out.Host = pr.In.Host
+			}
+			stripHeaders(pr.Out.Header, stripSet)
+			setIdentityHeaders(pr.Out.Header, site, st.session)
+			setAssertion(pr.Out.Header, site, st.session)
+			if site.PassAccessToken {
+				// クライアントが送ってきたトークンは、ユーザーのものと取り違えないように送らない
+				pr.Out.Header.Del("Authorization")
+				if s := st.session; s != nil {
+					if token, ok := s.bearerToken(); ok {
+						pr.Out.Header.Set("Authorization", "Bearer "+token)
+					}
+				}
+			}
+			if key := site.SigningKey(); key != nil {
+				signature.Sign(pr.Out, key, site.SignedHeaderNames(), time.Now())
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			st := stateOf(r.Context())
+			log.Println("バックエンドへのリクエストに失敗した", st.backend.URL.String(), err)
+			if isBackendFailure(r, err) {
+				st.err = err
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	if site.RewritesPath() {
+		p.rp.ModifyResponse = func(res *http.Response) error {
+			restoreResponsePaths(res, site, stateOf(res.Request.Context()).backend.URL)
+			return nil
+		}
+	}
+	return p, nil
+}
+
+// ServeHTTP はバックエンドにリクエストを転送する。s はアクセスを許可したユーザーのセッションで、ログインしていなければ nil を渡す。
+func (p *siteProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, s *Session) {
+	// hash で同じユーザーを同じバックエンドに振り分ける。ログインしていなければ IP アドレスで振り分ける
+	key := access.ClientIP(r.RemoteAddr, r.Header.Values("X-Forwarded-For")).String()
+	if s != nil {
+		key = s.Sub
+	}
+
+	b, err := p.pool.Pick(key)
+	if err != nil {
+		log.Println(err, p.site.ID)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("利用できるバックエンドがありません"))
+		return
+	}
+
+	st := &proxyState{backend: b, session: s}
+	// レスポンスのコピー中にクライアントが切断すると ReverseProxy は http.ErrAbortHandler で panic するので、defer で必ず戻す
+	defer func() { p.pool.Done(b, st.err) }()
+	p.rp.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyStateKey{}, st)))
+}
+
+// isBackendFailure はバックエンドを外す理由になる失敗かどうかを返す。
+// 接続やタイムアウトの失敗だけを数え、クライアントが切断した場合や Rewrite などプロキシ側のエラーは数えない。
+func isBackendFailure(r *http.Request, err error) bool {
+	if r.Context().Err() != nil {
+		return false
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// setIdentityHeaders はサイトが求める場合に、s の情報をヘッダーに入れる。
+func setIdentityHeaders(h http.Header, site *access.Site, s *Session) {
+	names := site.IdentityHeaders
+	if names == nil || s == nil {
+		return
+	}
+	h.Set(names.User, s.Sub)
+	if email, ok := s.Claims["email"].(string); ok {
+		h.Set(names.Email, email)
+	}
+	h.Set(names.Roles, strings.Join(s.Roles, ","))
+}
+
+func newTransport(c access.Transport) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   c.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// headerKey はヘッダーの名前を比べるための文字列を返す。
+// CGI や WSGI では - と _ がどちらも HTTP_X_FORWARDED_USER のようになるので、_ も - とみなす。
+func headerKey(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+}
+
+// stripHeaders は names (headerKey で作ったもの) に当たるヘッダーを取り除く。X_Forwarded_User のような書き方も取り除く。
+func stripHeaders(h http.Header, names map[string]bool) {
+	for name := range h {
+		if names[headerKey(name)] {
+			delete(h, name)
+		}
+	}
+}
+
+// stripHeaderNames はクライアントから受け取っても転送しないヘッダーの名前を返す。
+// 別のサイトで使っている名前でも、ユーザーの情報や署名を装ったヘッダーは送らない。
+func stripHeaderNames(sites []access.Site) []string {
+	names := []string{signature.TimestampHeader, signature.SignedHeadersHeader, signature.SignatureHeader}
+	seen := make(map[string]bool)
+	for i := range sites {
+		for _, name := range sites[i].IdentityHeaderNames() {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// buildSiteProxies は読み込んだ設定のサイトごとにリバースプロキシを作り直し、古いものを片付ける。
+// 作れなかったサイトはログに出して飛ばすので、エラーは返さない。
+func buildSiteProxies(l *access.SettingList) error {
+	buildMu.Lock()
+	defer buildMu.Unlock()
+
+	strip := stripHeaderNames(l.Sites)
+
+	next := make(map[string]*siteProxy, len(l.Sites))
+	used := make(map[access.Transport]*http.Transport)
+	for i := range l.Sites {
+		site := &l.Sites[i]
+
+		c := *site.Transport
+		t, ok := transports[c]
+		if !ok {
+			t = newTransport(c)
+		}
+		used[c] = t
+
+		p, err := newSiteProxy(site, t, strip)
+		if err != nil {
+			log.Println(err, site.ID)
+			continue
+		}
+		p.pool.Start()
+		next[site.ID] = p
+	}
+
+	// 二つ前の設定のプロキシは捨てる
+	siteProxiesMu.Lock()
+	prev := siteProxies
+	prevSiteProxies = prev
+	siteProxies = next
+	siteProxiesMu.Unlock()
+
+	// ひとつ前の設定のプロキシはリクエストを捌けるように残すが、ヘルスチェックは新しい設定の分だけでよいので止める
+	for _, p := range prev {
+		p.pool.Stop()
+	}
+	for c, t := range transports {
+		if _, ok := used[c]; !ok {
+			t.CloseIdleConnections()
+		}
+	}
+	transports = used
+	return nil
+}
+
+// proxyFor はサイトのリバースプロキシを返す。
+func proxyFor(site *access.Site) *siteProxy {
+	siteProxiesMu.RLock()
+	p, ok := siteProxies[site.ID]
+	if !ok || p.site != site {
+		p, ok = prevSiteProxies[site.ID]
+	}
+	siteProxiesMu.RUnlock()
+	if ok && p.site == site {
+		return p
+	}
+
+	// 設定の読み込みが続けて重なり、二つ以上前の設定のサイトが来た場合は、その場で作って間に合わせる
+	log.Println("サイトのリバースプロキシがないので作る", site.ID)
+	p, err := newSiteProxy(site, http.DefaultTransport.(*http.Transport), stripHeaderNames([]access.Site{*site}))
+	if err != nil {
+		log.Println(err, site.ID)
+		return &siteProxy{site: site, pool: &upstream.Pool{}}
+	}
+	return p
+}
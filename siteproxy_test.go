@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/comame/id-proxy/access"
+)
+
+var registerHook sync.Once
+
+// benchSites は設定に並べるサイトの数。実際の設定のように、転送先のサイトより前にほかのサイトを並べる。
+const benchSites = 50
+
+// loadBenchSite は backend に転送するサイトを含む設定を読み込む。
+func loadBenchSite(b *testing.B, backend string) {
+	b.Helper()
+	registerHook.Do(func() {
+		access.OnLoad(buildSiteProxies)
+	})
+
+	var yml strings.Builder
+	yml.WriteString("sites:\n")
+	for i := 0; i < benchSites; i++ {
+		fmt.Fprintf(&yml, "  - id: other%d\n    host: other%d.example.com\n    auth: public\n    backend: %s\n", i, i, backend)
+	}
+	fmt.Fprintf(&yml, "  - id: bench\n    host: example.com\n    auth: public\n    backend: %s\n", backend)
+
+	path := filepath.Join(b.TempDir(), "list.yml")
+	if err := os.WriteFile(path, []byte(yml.String()), 0o600); err != nil {
+		b.Fatal(err)
+	}
+	if err := access.Load(path); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func newBenchBackend(b *testing.B) *httptest.Server {
+	b.Helper()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	b.Cleanup(s.Close)
+	return s
+}
+
+func newBenchRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	r.RemoteAddr = "192.0.2.1:12345"
+	return r
+}
+
+// BenchmarkPerRequestReverseProxy は、リクエストごとにサイトを探し直して ReverseProxy を作っていたころの転送を測る。
+// 以前は CanAccess、BackendURL、SiteConfig がそれぞれサイトの一覧を探し、http.DefaultTransport で転送していた。
+func BenchmarkPerRequestReverseProxy(b *testing.B) {
+	backend := newBenchBackend(b)
+	loadBenchSite(b, backend.URL)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := newBenchRequest()
+		var site *access.Site
+		for j := 0; j < 3; j++ {
+			var err error
+			if site, err = access.Current().SiteConfig(*r.URL); err != nil {
+				b.Fatal(err)
+			}
+		}
+		u, err := url.Parse(site.Backend)
+		if err != nil {
+			b.Fatal(err)
+		}
+		rp := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(u)
+				if site.DisguiseHostHeader {
+					pr.Out.Host = pr.In.Host
+				}
+			},
+		}
+
+		w := httptest.NewRecorder()
+		rp.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			b.Fatal(w.Code)
+		}
+	}
+}
+
+// BenchmarkSiteProxy は、サイトを一度だけ探し、設定の読み込み時に作ったサイトごとのプロキシで転送する場合を測る。
+// サイトごとのプロキシは、ヘッダーの除去やバランシングなど以前はなかった処理もするので、その分も含む。
+func BenchmarkSiteProxy(b *testing.B) {
+	backend := newBenchBackend(b)
+	loadBenchSite(b, backend.URL)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := newBenchRequest()
+		site, err := access.Current().SiteConfig(*r.URL)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		proxyFor(site).ServeHTTP(w, r, nil)
+		if w.Code != http.StatusOK {
+			b.Fatal(w.Code)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Package upstream はサイトの複数のバックエンドへの振り分けと、バックエンドの死活監視を行う。
+package upstream
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/comame/id-proxy/access"
+)
+
+var ErrNoHealthyBackend = errors.New("no healthy backend")
+
+// リダイレクトもバックエンドが応答したとみなすので、たどらない
+var healthClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+type Backend struct {
+	URL *url.URL
+
+	// アクティブヘルスチェックの結果
+	healthy atomic.Bool
+	// 続けて接続に失敗した回数と、振り分けを再開する時刻 (UnixNano)
+	fails        atomic.Int32
+	ejectedUntil atomic.Int64
+	// 処理中のリクエストの数
+	active atomic.Int64
+}
+
+func (b *Backend) available(now time.Time) bool {
+	return b.healthy.Load() && now.UnixNano() >= b.ejectedUntil.Load()
+}
+
+type Pool struct {
+	backends    []*Backend
+	balance     access.Balance
+	healthCheck *access.HealthCheck
+	maxFails    int
+	failTimeout time.Duration
+
+	next   atomic.Uint64
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewPool はサイトのバックエンドのプールを作る。ヘルスチェックを始めるには Start を呼ぶ。
+func NewPool(site *access.Site) (*Pool, error) {
+	p := &Pool{
+		balance:     site.Balance,
+		healthCheck: site.HealthCheck,
+		maxFails:    site.MaxFails,
+		failTimeout: site.FailTimeout,
+	}
+	for _, raw := range site.BackendURLs() {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		b := &Backend{URL: u}
+		b.healthy.Store(true)
+		p.backends = append(p.backends, b)
+	}
+	return p, nil
+}
+
+// Pick はリクエストを振り分けるバックエンドを選ぶ。key は hash で使う。
+// 使い終わったら Done を呼ぶ。
+func (p *Pool) Pick(key string) (*Backend, error) {
+	now := time.Now()
+
+	var b *Backend
+	switch p.balance {
+	case access.BalanceLeastConn:
+		b = p.leastConn(now)
+	case access.BalanceHash:
+		b = p.hash(key, now)
+	default:
+		b = p.roundRobin(now)
+	}
+	if b == nil {
+		return nil, ErrNoHealthyBackend
+	}
+
+	b.active.Add(1)
+	return b, nil
+}
+
+// Done はリクエストが終わったことを記録する。err は接続に失敗した場合に渡す。
+func (p *Pool) Done(b *Backend, err error) {
+	b.active.Add(-1)
+
+	if err == nil {
+		b.fails.Store(0)
+		return
+	}
+	// maxFails が 0 の場合は外さない
+	if p.maxFails == 0 || int(b.fails.Add(1)) < p.maxFails {
+		return
+	}
+	b.fails.Store(0)
+
+	// すべて外すと 503 しか返せなくなるので、ほかに振り分けられるバックエンドがなければ外さない
+	now := time.Now()
+	if !p.othersAvailable(b, now) {
+		log.Println("ほかに振り分けられるバックエンドがないので外さない", b.URL.String(), err)
+		return
+	}
+	b.ejectedUntil.Store(now.Add(p.failTimeout).UnixNano())
+	log.Println("バックエンドを一時的に外す", b.URL.String(), err)
+}
+
+func (p *Pool) othersAvailable(b *Backend, now time.Time) bool {
+	for _, o := range p.backends {
+		if o != b && o.available(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Pool) roundRobin(now time.Time) *Backend {
+	n := uint64(len(p.backends))
+	start := p.next.Add(1) - 1
+	for i := uint64(0); i < n; i++ {
+		b := p.backends[(start+i)%n]
+		if b.available(now) {
+			return b
+		}
+	}
+	return nil
+}
+
+func (p *Pool) leastConn(now time.Time) *Backend {
+	// 同数の場合に先頭に偏らないよう、ラウンドロビンの位置から探す
+	n := uint64(len(p.backends))
+	start := p.next.Add(1) - 1
+	var best *Backend
+	for i := uint64(0); i < n; i++ {
+		b := p.backends[(start+i)%n]
+		if !b.available(now) {
+			continue
+		}
+		if best == nil || b.active.Load() < best.active.Load() {
+			best = b
+		}
+	}
+	return best
+}
+
+// hash は Rendezvous hashing で key に対応するバックエンドを選ぶ。
+// バックエンドが外れても、そのバックエンドに振り分けていた key 以外は振り分け先が変わらない。
+func (p *Pool) hash(key string, now time.Time) *Backend {
+	var best *Backend
+	var bestScore uint64
+	for _, b := range p.backends {
+		if !b.available(now) {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(b.URL.String()))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if score := mix(h.Sum64()); best == nil || score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+// mix は FNV の末尾の数バイトだけが違う入力でも偏らないように、ビットを混ぜる (splitmix64 の最後の処理)。
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Start はヘルスチェックを始める。healthCheck を書いていない場合は何もしない。
+func (p *Pool) Start() {
+	if p.healthCheck == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	for _, b := range p.backends {
+		p.wg.Add(1)
+		go func(b *Backend) {
+			defer p.wg.Done()
+			p.watch(ctx, b)
+		}(b)
+	}
+}
+
+// Stop はヘルスチェックを止める。
+func (p *Pool) Stop() {
+	if p.cancel == nil {
+		return
+	}
+	p.cancel()
+	p.wg.Wait()
+}
+
+func (p *Pool) watch(ctx context.Context, b *Backend) {
+	t := time.NewTicker(p.healthCheck.Interval)
+	defer t.Stop()
+
+	for {
+		ok := p.check(ctx, b)
+		if ctx.Err() != nil {
+			return
+		}
+		if b.healthy.Swap(ok) != ok {
+			if ok {
+				log.Println("バックエンドが復帰した", b.URL.String())
+			} else {
+				log.Println("バックエンドのヘルスチェックに失敗した", b.URL.String())
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (p *Pool) check(ctx context.Context, b *Backend) bool {
+	ctx, cancel := context.WithTimeout(ctx, p.healthCheck.Timeout)
+	defer cancel()
+
+	u := b.URL.JoinPath(p.healthCheck.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false
+	}
+	res, err := healthClient.Do(req)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode >= 200 && res.StatusCode < 400
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/comame/id-proxy/access"
+)
+
+// listPathFromArgs は引数か LIST_PATH で指定された設定ファイルのパスを返す。
+func listPathFromArgs(args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	if p := os.Getenv("LIST_PATH"); p != "" {
+		return p
+	}
+	return defaultListPath
+}
+
+// runValidate は設定ファイルを検証し、エラーがあれば 1 を返す。
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	expand := fs.Bool("expand", false, "templates と roleGroups を展開したあとのサイトを表示する")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: id-proxy validate [options] [list.yml]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	path := listPathFromArgs(fs.Args())
+
+	// サーバーと同じく、assertion の鍵があるかどうかも確かめる
+	env.AssertionKeyPath = os.Getenv("ASSERTION_KEY_PATH")
+	if err := initSigningKeys(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	registerLoadChecks()
+
+	exit := 0
+	problems := access.ValidatePath(path)
+	for _, p := range problems {
+		level := "error"
+		if p.Warning {
+			level = "warning"
+		} else {
+			exit = 1
+		}
+
+		file := p.File
+		if file == "" {
+			file = path
+		}
+		if p.Line == 0 {
+			fmt.Printf("%s: %s: %s\n", file, level, p.Message)
+			continue
+		}
+		fmt.Printf("%s:%d: %s: %s\n", file, p.Line, level, p.Message)
+	}
+
+	if len(problems) == 0 {
+		fmt.Printf("%s: ok\n", path)
+	}
+
+	if *expand && exit == 0 {
+		l, err := access.ParsePath(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, site := range l.Sites {
+			fmt.Printf("%s: host=%s path=%s%s%s roles=%v backend=%s", site.ID, site.Host, site.PathPrefix, site.PathGlob, site.PathRegex, site.Roles, strings.Join(site.BackendURLs(), ","))
+			if site.Extends != "" {
+				fmt.Printf(" extends=%s", site.Extends)
+			}
+			fmt.Println()
+		}
+	}
+	return exit
+}